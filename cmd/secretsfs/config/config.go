@@ -28,10 +28,25 @@ general:
   logging:
     level: info
 
+  inodes:
+    # number of inodes kept in memory before inodes only listed in directories
+    # and not looked up for a minute are garbage collected, 0 disables garbage
+    # collection. Inodes forgotten by the kernel are always removed.
+    max: 10000
+
+  # every user is reported as owner of all files, with permissions configured
+  # in fio.<name>.permissions, restricted to what the user may access in the
+  # store
+  # defaultpermissions lets the kernel enforce these permissions by mounting
+  # with option default_permissions, the kernel doesn't cache attributes then
+  defaultpermissions: false
+
 fio:
   enabled:
     - secretsfiles
     - templatefiles
+    - versions
+    - formats
     - internal
   templatefiles:
     # add additional locations for template files
@@ -40,7 +55,49 @@ fio:
     templatespaths:
       default: /etc/secretsfs/templates/
       #applA: /appl/applA
+    # templates in this directory are available in the templatefiles of all
+    # templatespaths, e.g. for shared layouts, additionally to the templates in
+    # the '_partials/' directory of each templatespath
+    partialspath: ""
+    # rendered templates depend on the calling user, so the kernel must not
+    # cache them and serve them to other users
+    cache:
+      kernel: false
+      # how long rendered templates are cached per user, so that stat and read
+      # don't render them twice, modifying templates or changing the versions
+      # of their secrets invalidates them, templates using env or .Caller are
+      # never cached, 0 disables the cache
+      render_ttl: 2s
+    # render templates on stat to report their size, otherwise their size is
+    # reported as 0, reading them is not affected
+    renderonstat: true
   secretsfiles:
+    # allow writing keys and creating or deleting secrets, users still need
+    # the corresponding policies in the store
+    writable: false
+    # how long the kernel caches names and attributes like the size of keys,
+    # the kernel caches them for all users, so with allow_other other users
+    # may see them until they expire
+    # kernel: false disables all caching by the kernel, including the content
+    cache:
+      entry_ttl: 1s
+      attr_ttl: 1s
+      #kernel: true
+    # permissions of keys and secrets, owner write permission is added if
+    # writable is set, quote them for octal notation
+    permissions:
+      file: "0400"
+      dir: "0500"
+  versions:
+    # versions never change, but current changes with every write
+    cache:
+      entry_ttl: 1s
+      attr_ttl: 1s
+  formats:
+    # like secretsfiles, the kernel caches the rendered secrets for all users
+    cache:
+      entry_ttl: 1s
+      attr_ttl: 1s
   internal:
     # privileges given to users or groups for listing and reading files in internal
     # do not make this readable for all, as it may contain critical data due to path namings
@@ -49,10 +106,40 @@ fio:
         - root
       groups:
         - admin
+    cache:
+      kernel: false
 
 store:
-  enabled: vault
+  # store used as backend, see --print-stores for all available stores
+  enabled: vault_kv
+
+  # secrets are cached per user, so that listing directories doesn't request
+  # every secret multiple times, changes made outside of secretsfs may be seen
+  # only after the ttl expired
+  cache:
+    # how long secrets are cached, 0 disables the cache
+    ttl: 5s
+    # how long missing secrets are cached, 0 disables caching them
+    negativettl: 1s
+    # maximum number of cached secrets
+    maxentries: 10000
+
   vault:
+    auth:
+      # auth method used for logging in users {approle,token,userpass,ldap,kubernetes,jwt,cert}
+      method: approle
+
+      # serviceidentity logs in with the user running secretsfs instead of the
+      # calling user, all callers share this identity and see the same secrets
+      # e.g. for running secretsfs as sidecar projecting secrets into a pod
+      serviceidentity: false
+
+      # useroverride configures auth methods per user, takes precedence over
+      # store.vault.auth.method
+      #useroverride:
+      #  <usernameA>: <auth method>
+
+    # used by auth method approle
     roleid:
       # path configuration defines, where to look for the vault roleid token
       # $HOME will be substituted with the user's corresponding home directory
@@ -67,6 +154,100 @@ store:
       #useroverride:
       #  <usernameA>: <path>
 
+    # used by auth method approle, only needed for approles with bind_secret_id=true
+    secretid:
+      # path configuration defines, where to look for the vault secret_id
+      # $HOME will be substituted like in store.vault.roleid.file
+      #file: "$HOME/.vault-secretid"
+
+      # whether the file contains a response wrapping token wrapping the secret_id
+      # instead of the secret_id itself
+      wrapped: false
+
+      # useroverride configures paths per user like store.vault.roleid.useroverride
+      #useroverride:
+      #  <usernameA>: <path>
+
+    # used by auth method token
+    token:
+      # file containing the token, e.g. written by 'vault login'
+      file: "$HOME/.vault-token"
+      #useroverride:
+      #  <usernameA>: <path>
+
+    # used by auth method userpass
+    userpass:
+      # file containing the password, optionally preceded by a line containing the
+      # username, defaults to the name of the user
+      file: "$HOME/.vault-userpass"
+      # path of the auth method in vault
+      mount: userpass
+      #useroverride:
+      #  <usernameA>: <path>
+
+    # used by auth method ldap
+    ldap:
+      # file containing the password like store.vault.userpass.file
+      file: "$HOME/.vault-ldap"
+      # path of the auth method in vault
+      mount: ldap
+      #useroverride:
+      #  <usernameA>: <path>
+
+    # used by auth method kubernetes
+    kubernetes:
+      # file containing the service account token
+      file: /var/run/secrets/kubernetes.io/serviceaccount/token
+      # role of the auth method to log in with
+      role: secretsfs
+      # path of the auth method in vault
+      mount: kubernetes
+
+    # used by auth method jwt, for JWT and OIDC
+    jwt:
+      # file containing the JWT
+      file: /var/run/secrets/kubernetes.io/serviceaccount/token
+      # role of the auth method to log in with
+      role: secretsfs
+      # path of the auth method in vault
+      mount: jwt
+
+    # used by auth method cert
+    cert:
+      # client certificate and private key presented for logging in
+      certfile: $HOME/.vault/cert.pem
+      keyfile: $HOME/.vault/key.pem
+      # name of the certificate role to log in with, all roles are tried if
+      # unset
+      #name: <role>
+      # path of the auth method in vault
+      mount: cert
+      # useroverride takes precedence over groupoverride
+      #useroverride:
+      #  <usernameA>:
+      #    certfile: <path>
+      #    keyfile: <path>
+      #groupoverride:
+      #  <groupnameA>:
+      #    certfile: /etc/pki/tls/certs/host.pem
+      #    keyfile: /etc/pki/tls/private/host.key
+
+    # mounts of the KV secret engine, each mount is displayed as its own top
+    # level directory, e.g. 'secretsfiles/secret/'
+    mounts:
+      # path of the mount in vault
+      - path: secret/
+        # name of the top level directory, defaults to path with '/' replaced by '_'
+        #name: secret
+        # version of the KV secret engine {1,2}, 0 detects the version automatically
+        #kvversion: 0
+
+    # values of keys ending with base64suffix are base64 decoded, the keys are
+    # displayed without the suffix, e.g. 'keytab.b64' as 'keytab'
+    # binary values written are stored base64 encoded with the suffix as well
+    # an empty suffix disables decoding
+    base64suffix: .b64
+
     # address of the vault instance, that shall be accessed
     # differenciates between http:// and https:// protocols
     # defaults to a local dev instance
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -67,8 +68,12 @@ func main() {
 		os.Exit(0)
 	}
 
-	// print currently set store
+	// print currently set store, --print-store
 	if *currentstore {
+		if err := store.InitStore(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 		fmt.Printf("Currently set store is: %s\n", (*store.GetStore()).String())
 		os.Exit(0)
 	}
@@ -109,8 +114,18 @@ func main() {
 		os.Exit(2)
 	}
 	log.WithFields(log.Fields{"mountpoint": mountpoint}).Debug("log values")
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		sfs.SetMountPoint(abs)
+	}
 	// ARGUMENT THINGIES END
 
+	// choose the configured store before serving any requests
+	if err := store.InitStore(); err != nil {
+		log.WithFields(log.Fields{"store.enabled": viper.GetString("store.enabled"), "error": err}).Error("could not initialize store")
+		os.Exit(4)
+	}
+	log.WithFields(log.Fields{"store": (*store.GetStore()).String()}).Info("store initialized")
+
 	// This is where we'll mount the FS
 	fms := sfs.FIOMapsEnabled()
 	log.Debugf("fms: %v\n", fms)
@@ -121,8 +136,16 @@ func main() {
 	if *fusedebug {
 		fsopts.Debug = true
 	}
-	server, err := fs.Mount(mountpoint, root, &fs.Options{
+	// let the kernel enforce the permissions reported by secretsfs
+	if hasOption(fsopts.Options, "default_permissions") {
+		viper.Set("general.defaultpermissions", true)
+	} else if viper.GetBool("general.defaultpermissions") {
+		fsopts.Options = append(fsopts.Options, "default_permissions")
+	}
+	server, err := sfs.Mount(mountpoint, root, &fs.Options{
 		MountOptions: fsopts,
+		// FIOs report nodes without permissions, if the user may not access them
+		NullPermissions: true,
 	})
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Errorf("error while mounting %s", os.Args[0])
@@ -145,6 +168,16 @@ func usage() {
 	flag.PrintDefaults()
 }
 
+// hasOption returns whether the mount option name is contained in opts
+func hasOption(opts []string, name string) bool {
+	for _, o := range opts {
+		if o == name {
+			return true
+		}
+	}
+	return false
+}
+
 // firstDashedArg returns the index of the first dashed argument, e.g. -ex
 // https://stackoverflow.com/a/51526473/4069534
 func firstDashedArg() int {
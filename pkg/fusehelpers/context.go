@@ -1,7 +1,12 @@
 package fusehelpers
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/user"
 	"strconv"
 
@@ -14,3 +19,44 @@ func GetUserFromContext(ctx context.Context) (*user.User, error) {
 	u, err := user.LookupId(strconv.Itoa(int(c.Caller.Owner.Uid)))
 	return u, err
 }
+
+// GetOwnerFromContext returns the uid and gid of the user that called the
+// filesystem operation
+func GetOwnerFromContext(ctx context.Context) (fuse.Owner, bool) {
+	c, ok := ctx.(*fuse.Context)
+	if !ok {
+		return fuse.Owner{}, false
+	}
+	return c.Caller.Owner, true
+}
+
+// GetEnvFromContext returns the value of the environment variable name of the
+// process that called the filesystem operation. The environment is read from
+// /proc, so it is the one the process was started with.
+func GetEnvFromContext(ctx context.Context, name string) (string, bool, error) {
+	c, ok := ctx.(*fuse.Context)
+	if !ok || c.Caller.Pid == 0 {
+		return "", false, errors.New("no calling process in context")
+	}
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", c.Caller.Pid))
+	if err != nil {
+		return "", false, err
+	}
+	prefix := []byte(name + "=")
+	for _, v := range bytes.Split(environ, []byte{0}) {
+		if bytes.HasPrefix(v, prefix) {
+			return string(v[len(prefix):]), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// GetExecutableFromContext returns the path of the executable of the process
+// that called the filesystem operation
+func GetExecutableFromContext(ctx context.Context) (string, error) {
+	c, ok := ctx.(*fuse.Context)
+	if !ok || c.Caller.Pid == 0 {
+		return "", errors.New("no calling process in context")
+	}
+	return os.Readlink(fmt.Sprintf("/proc/%d/exe", c.Caller.Pid))
+}
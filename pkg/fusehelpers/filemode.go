@@ -1,20 +1,30 @@
 package fusehelpers
 
 import (
+	"syscall"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// Modes of secrets returned by stores. The permission bits tell whether the
+// calling user may read the secret, they are for the owner, as the caller is
+// reported as owner of all files.
 const (
-	FILEREAD   = fuse.S_IFREG + 0x0755
-	FILENOREAD = fuse.S_IFREG + 0x0700
-	DIRREAD    = fuse.S_IFDIR + 0x0755
-	DIRNOREAD  = fuse.S_IFDIR + 0x0700
+	FILEREAD   = fuse.S_IFREG | 0400
+	FILENOREAD = fuse.S_IFREG
+	DIRREAD    = fuse.S_IFDIR | 0500
+	DIRNOREAD  = fuse.S_IFDIR | 0100 // may be traversed, but not listed
+	SYMLINK    = fuse.S_IFLNK | 0777 // permissions of symlinks are never checked
 )
 
 func IsFile(mode int64) bool {
-	return fuse.S_IFREG&mode == fuse.S_IFREG
+	return mode&syscall.S_IFMT == fuse.S_IFREG
 }
 
 func IsDir(mode int64) bool {
-	return fuse.S_IFDIR&mode == fuse.S_IFDIR
+	return mode&syscall.S_IFMT == fuse.S_IFDIR
+}
+
+func IsSymlink(mode int64) bool {
+	return mode&syscall.S_IFMT == fuse.S_IFLNK
 }
@@ -2,7 +2,9 @@ package secretsfs
 
 import (
 	"context"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -30,10 +32,137 @@ type FIORoot interface {
 	Read(n *SfsNode, ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
 	Getattr(n *SfsNode, ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno
 
+	// Writing Node Operations, see FIOReadOnly for FIOs not supporting them
+	Create(n *SfsNode, ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno)
+	Write(n *SfsNode, ctx context.Context, f fs.FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno)
+	Setattr(n *SfsNode, ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
+	Unlink(n *SfsNode, ctx context.Context, name string) syscall.Errno
+	Mkdir(n *SfsNode, ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno)
+	Rmdir(n *SfsNode, ctx context.Context, name string) syscall.Errno
+	Flush(n *SfsNode, ctx context.Context, f fs.FileHandle) syscall.Errno
+
+	// Symlinks, see FIONoSymlinks for FIOs not having them
+	Readlink(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno)
+
+	// Extended Attributes, see FIONoXattr for FIOs not supporting them
+	Getxattr(n *SfsNode, ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno)
+	Listxattr(n *SfsNode, ctx context.Context, dest []byte) (uint32, syscall.Errno)
+	Setxattr(n *SfsNode, ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno
+	Removexattr(n *SfsNode, ctx context.Context, attr string) syscall.Errno
+
 	// FIOPath() is used for registering and finding FIOMaps
 	FIOPath() string
 }
 
+// FIOReadOnly implements the writing operations of FIORoot for FIOs that are
+// read only. Embed it into the FIO to refuse all writes with EROFS.
+type FIOReadOnly struct{}
+
+func (r *FIOReadOnly) Create(n *SfsNode, ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return nil, nil, 0, syscall.EROFS
+}
+
+func (r *FIOReadOnly) Write(n *SfsNode, ctx context.Context, f fs.FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	return 0, syscall.EROFS
+}
+
+func (r *FIOReadOnly) Setattr(n *SfsNode, ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (r *FIOReadOnly) Unlink(n *SfsNode, ctx context.Context, name string) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (r *FIOReadOnly) Mkdir(n *SfsNode, ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, syscall.EROFS
+}
+
+func (r *FIOReadOnly) Rmdir(n *SfsNode, ctx context.Context, name string) syscall.Errno {
+	return syscall.EROFS
+}
+
+// Flush is called on every close, also for files opened read only
+func (r *FIOReadOnly) Flush(n *SfsNode, ctx context.Context, f fs.FileHandle) syscall.Errno {
+	return fs.OK
+}
+
+// FIONoSymlinks implements Readlink of FIORoot for FIOs without symlinks.
+// Embed it into the FIO to report none.
+type FIONoSymlinks struct{}
+
+func (s *FIONoSymlinks) Readlink(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
+	return nil, syscall.EINVAL
+}
+
+// FIONoXattr implements the extended attribute operations of FIORoot for FIOs
+// without extended attributes. Embed it into the FIO to report none.
+type FIONoXattr struct{}
+
+func (x *FIONoXattr) Getxattr(n *SfsNode, ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return 0, syscall.ENODATA
+}
+
+func (x *FIONoXattr) Listxattr(n *SfsNode, ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return 0, fs.OK
+}
+
+func (x *FIONoXattr) Setxattr(n *SfsNode, ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (x *FIONoXattr) Removexattr(n *SfsNode, ctx context.Context, attr string) syscall.Errno {
+	return syscall.ENODATA
+}
+
+// kernelCache configures how long the kernel may cache the nodes of a FIO
+type kernelCache struct {
+	enabled bool
+	entry   time.Duration // timeout of names looked up
+	attr    time.Duration // timeout of attributes like size and mode
+}
+
+// getKernelCache returns the kernel cache configuration of the FIO at
+// rootpath, configured with fio.<rootpath>.cache.
+// If fio.<rootpath>.cache.kernel is false, nothing is cached by the kernel,
+// not even the content of files.
+func getKernelCache(rootpath string) kernelCache {
+	key := "fio." + rootpath + ".cache."
+	if viper.IsSet(key+"kernel") && !viper.GetBool(key+"kernel") {
+		return kernelCache{}
+	}
+	kc := kernelCache{
+		enabled: true,
+		entry:   viper.GetDuration(key + "entry_ttl"),
+		attr:    viper.GetDuration(key + "attr_ttl"),
+	}
+	// the kernel checks permissions against cached attributes, which are
+	// shared by all users, while every user is reported as owner
+	if viper.GetBool("general.defaultpermissions") {
+		kc.attr = 0
+	}
+	return kc
+}
+
+// getPermissions returns the permission bits configured at key as octal
+// number like "0400", def if it isn't set or invalid
+func getPermissions(key string, def uint32) uint32 {
+	switch v := viper.Get(key).(type) {
+	case nil:
+		return def
+	case int:
+		// unquoted numbers with a leading 0 are already parsed as octal
+		return uint32(v) & 07777
+	default:
+		p, err := strconv.ParseUint(viper.GetString(key), 8, 32)
+		if err != nil {
+			log.WithFields(log.Fields{"key": key, "value": v, "error": err}).Warn("invalid permissions, using default")
+			return def
+		}
+		return uint32(p) & 07777
+	}
+}
+
 // FIOMap maps the FIORoot Node to a Mountpath
 // Used for registering FIORoots to the secretsfs rootnode
 type FIOMap struct {
@@ -0,0 +1,378 @@
+package secretsfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+// FIOFormats shows every secret as files containing all of its keys, one
+// file per format:
+//
+//	formats/
+//	└── secret
+//	    └── app
+//	        ├── db
+//	        ├── db.env
+//	        ├── db.json
+//	        ├── db.properties
+//	        └── db.yaml
+type FIOFormats struct {
+	FIOReadOnly
+	FIONoSymlinks
+	FIONoXattr
+}
+
+var _ = (FIORoot)((*FIOFormats)(nil))
+
+// secretFormats contains the functions serializing the keys of a secret
+// mapped to the extension of their files
+var secretFormats = map[string]func(keys map[string]string) []byte{
+	".env":        formatEnv,
+	".json":       formatJSON,
+	".properties": formatProperties,
+	".yaml":       formatYAML,
+}
+
+// formatExtensions returns the extensions of all secretFormats sorted
+func formatExtensions() []string {
+	exts := make([]string, 0, len(secretFormats))
+	for ext := range secretFormats {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// sortedKeys returns the names of keys sorted, so that files are rendered
+// the same every time
+func sortedKeys(keys map[string]string) []string {
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonString returns s as JSON string. HTML characters aren't escaped, as
+// the files aren't embedded into HTML.
+func jsonString(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s) // encoding a string never fails
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// formatJSON renders keys as JSON object
+func formatJSON(keys map[string]string) []byte {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, k := range sortedKeys(keys) {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "\n  %s: %s", jsonString(k), jsonString(keys[k]))
+	}
+	if len(keys) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// formatYAML renders keys as YAML mapping. All keys and values are quoted, so
+// that values like "yes" or "0400" stay strings. JSON strings are valid
+// double quoted YAML scalars.
+func formatYAML(keys map[string]string) []byte {
+	if len(keys) == 0 {
+		return []byte("{}\n")
+	}
+	var b bytes.Buffer
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(&b, "%s: %s\n", jsonString(k), jsonString(keys[k]))
+	}
+	return b.Bytes()
+}
+
+// formatEnv renders keys as dotenv file. Values are double quoted, invalid
+// characters in the names of keys are replaced with '_'.
+func formatEnv(keys map[string]string) []byte {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(&b, "%s=\"%s\"\n", envName(k), envEscaper.Replace(keys[k]))
+	}
+	return b.Bytes()
+}
+
+// envEscaper escapes values inside of double quotes of dotenv files
+var envEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"$", `\$`,
+	"`", "\\`",
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// envName returns key as valid name of an environment variable
+func envName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// formatProperties renders keys as Java properties file, escaped like
+// java.util.Properties.store, so that it can be read in ISO 8859-1 as well
+func formatProperties(keys map[string]string) []byte {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(&b, "%s=%s\n", propertiesEscape(k, true), propertiesEscape(keys[k], false))
+	}
+	return b.Bytes()
+}
+
+// propertiesEscape escapes s as key or value of a properties file. All spaces
+// of keys are escaped, but only the leading ones of values.
+func propertiesEscape(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch r {
+		case ' ':
+			if key || i == 0 {
+				b.WriteString(`\ `)
+			} else {
+				b.WriteRune(r)
+			}
+		case '\\', '=', ':', '#', '!':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 || r > 0x7e {
+				// characters outside of the BMP are written as surrogate pairs
+				if r > 0xffff {
+					r1, r2 := utf16.EncodeRune(r)
+					fmt.Fprintf(&b, `\u%04X\u%04X`, r1, r2)
+				} else {
+					fmt.Fprintf(&b, `\u%04X`, r)
+				}
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+func (ff *FIOFormats) Readdir(n *SfsNode, ctx context.Context) (out fs.DirStream, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+
+	sto := *store.GetStore()
+	_, secpath := rootName(n.npath)
+	sec, err := sto.GetSecret(secpath, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting secret")
+		return nil, errnoFromError(err)
+	}
+	if !sfsfh.IsDir(sec.Mode) {
+		return nil, syscall.ENOTDIR
+	}
+
+	var direntries []fuse.DirEntry
+	for _, v := range sec.Subs {
+		if !sfsfh.IsDir(v.Mode) {
+			continue
+		}
+		fixedpath := ff.prefixPath(v.Path)
+		direntries = append(direntries, fuse.DirEntry{
+			Name: filepath.Base(fixedpath),
+			Ino:  GetInode(fixedpath),
+			Mode: uint32(v.Mode),
+		})
+		// only secrets containing keys are rendered, the listing tells which
+		// ones, so that not every secret is read
+		if !v.HasKeys {
+			continue
+		}
+		for _, ext := range formatExtensions() {
+			direntries = append(direntries, fuse.DirEntry{
+				Name: filepath.Base(fixedpath) + ext,
+				Ino:  GetInode(fixedpath + ext),
+				Mode: uint32(sfsfh.FILEREAD),
+			})
+		}
+	}
+	log.WithFields(log.Fields{"direntries": direntries}).Debug("log values")
+	return fs.NewListDirStream(direntries), fs.OK
+}
+
+func (ff *FIOFormats) Lookup(n *SfsNode, ctx context.Context, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+
+	_, secpath := rootName(n.npath)
+	fullname := filepath.Join(secpath, name)
+	if ext := filepath.Ext(name); secretFormats[ext] != nil {
+		if _, errno := ff.keys(ctx, strings.TrimSuffix(fullname, ext)); errno == fs.OK {
+			return newChildInode(n, ctx, ff.prefixPath(fullname), uint32(sfsfh.FILEREAD), out), fs.OK
+		}
+	}
+
+	sto := *store.GetStore()
+	sec, err := sto.GetSecret(fullname, ctx)
+	if errors.Is(err, store.ErrPermissionDenied) {
+		// secrets below may still be readable, see FIOSecretsFiles.Lookup
+		sec = &store.Secret{Path: fullname, Mode: sfsfh.DIRNOREAD}
+	} else if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecret(fullname, ctx)", "fullname": fullname, "error": err}).Warn("got error while getting secret")
+		return nil, errnoFromError(err)
+	}
+	// keys are only shown rendered into their secret
+	if !sfsfh.IsDir(sec.Mode) {
+		return nil, syscall.ENOENT
+	}
+	return newChildInode(n, ctx, ff.prefixPath(fullname), uint32(sec.Mode), out), fs.OK
+}
+
+func (ff *FIOFormats) Open(n *SfsNode, ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "flags": strconv.FormatInt(int64(flags), 16)}).Debug("log values")
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	content, errno := ff.content(n, ctx)
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	return newContentHandle(content), 0, fs.OK
+}
+
+func (ff *FIOFormats) Read(n *SfsNode, ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	if h, ok := f.(*contentHandle); ok {
+		return h.read(dest, off), fs.OK
+	}
+	content, errno := ff.content(n, ctx)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	return fuse.ReadResultData(readAt(content, dest, off)), fs.OK
+}
+
+func (ff *FIOFormats) Getattr(n *SfsNode, ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+
+	out.Ino = GetInode(n.npath)
+	if IsRootPath(n.npath) || fh != nil || n.IsDir() {
+		return fs.OK
+	}
+	content, errno := ff.content(n, ctx)
+	if errno != fs.OK {
+		return errno
+	}
+	out.Size = uint64(len(content))
+	return fs.OK
+}
+
+func (ff *FIOFormats) FIOPath() string {
+	return "formats"
+}
+
+func (ff *FIOFormats) prefixPath(npath string) string {
+	return string(filepath.Separator) + filepath.Join(ff.FIOPath(), npath)
+}
+
+// keys returns the values of all keys of the secret secpath mapped to their
+// names. Paths not containing any keys return ENOENT, unless they are empty
+// secrets.
+func (ff *FIOFormats) keys(ctx context.Context, secpath string) (map[string]string, syscall.Errno) {
+	sto := *store.GetStore()
+	sec, err := sto.GetSecret(secpath, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Debug("got error while getting secret")
+		return nil, errnoFromError(err)
+	}
+	keys := formatKeys(sec.Subs, viper.GetString("store.vault.base64suffix"))
+	if len(keys) == 0 && !(sfsfh.IsDir(sec.Mode) && sec.HasKeys) {
+		return nil, syscall.ENOENT
+	}
+	return keys, fs.OK
+}
+
+// formatKeys returns the values of the keys in subs mapped to their names.
+// Values which aren't valid UTF-8 can't be rendered as strings, so they are
+// base64 encoded and their names get suffix appended, like they are stored.
+// Without suffix they are skipped.
+func formatKeys(subs []*store.Secret, suffix string) map[string]string {
+	keys := make(map[string]string)
+	for _, v := range subs {
+		if !sfsfh.IsFile(v.Mode) {
+			continue
+		}
+		name := filepath.Base(v.Path)
+		if utf8.Valid(v.Content) {
+			keys[name] = string(v.Content)
+		} else if suffix != "" {
+			keys[name+suffix] = base64.StdEncoding.EncodeToString(v.Content)
+		} else {
+			log.WithFields(log.Fields{"spath": v.Path}).Warn("skipping binary key, as store.vault.base64suffix is empty")
+		}
+	}
+	return keys
+}
+
+// content returns the secret of the file n rendered in the format of its
+// extension
+func (ff *FIOFormats) content(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
+	_, fullname := rootName(n.npath)
+	ext := filepath.Ext(fullname)
+	format := secretFormats[ext]
+	if format == nil {
+		return nil, syscall.EISDIR
+	}
+	keys, errno := ff.keys(ctx, strings.TrimSuffix(fullname, ext))
+	if errno != fs.OK {
+		return nil, errno
+	}
+	return format(keys), fs.OK
+}
+
+func init() {
+	fioroot := FIOFormats{}
+	fm := FIOMap{
+		Root: &fioroot,
+	}
+	RegisterRoot(&fm)
+}
@@ -0,0 +1,145 @@
+package secretsfs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+func TestSecretFormats(t *testing.T) {
+	keys := map[string]string{
+		"password":   "p\"w$1\\\n",
+		"db-user":    "app",
+		"port":       "5432",
+		"greeting":   " hello: wörld=😀",
+		"tls.crt":    "<cert>",
+		"2fa secret": "yes",
+	}
+	tables := []struct {
+		ext  string
+		keys map[string]string
+		want string
+	}{
+		{".json", keys, "{\n" +
+			"  \"2fa secret\": \"yes\",\n" +
+			"  \"db-user\": \"app\",\n" +
+			"  \"greeting\": \" hello: wörld=😀\",\n" +
+			"  \"password\": \"p\\\"w$1\\\\\\n\",\n" +
+			"  \"port\": \"5432\",\n" +
+			"  \"tls.crt\": \"<cert>\"\n" +
+			"}\n"},
+		{".json", map[string]string{}, "{}\n"},
+		{".yaml", keys, "\"2fa secret\": \"yes\"\n" +
+			"\"db-user\": \"app\"\n" +
+			"\"greeting\": \" hello: wörld=😀\"\n" +
+			"\"password\": \"p\\\"w$1\\\\\\n\"\n" +
+			"\"port\": \"5432\"\n" +
+			"\"tls.crt\": \"<cert>\"\n"},
+		{".yaml", map[string]string{}, "{}\n"},
+		{".env", keys, "_2fa_secret=\"yes\"\n" +
+			"db_user=\"app\"\n" +
+			"greeting=\" hello: wörld=😀\"\n" +
+			"password=\"p\\\"w\\$1\\\\\\n\"\n" +
+			"port=\"5432\"\n" +
+			"tls_crt=\"<cert>\"\n"},
+		{".properties", keys, "2fa\\ secret=yes\n" +
+			"db-user=app\n" +
+			"greeting=\\ hello\\: w\\u00F6rld\\=\\uD83D\\uDE00\n" +
+			"password=p\"w$1\\\\\\n\n" +
+			"port=5432\n" +
+			"tls.crt=<cert>\n"},
+	}
+
+	for _, table := range tables {
+		got := string(secretFormats[table.ext](table.keys))
+		if got != table.want {
+			t.Errorf("rendering %v was incorrect, got:\n%v\nwant:\n%v\n", table.ext, got, table.want)
+		}
+	}
+}
+
+func TestFormatKeys(t *testing.T) {
+	subs := []*store.Secret{
+		{Path: "secret/app/db/password", Mode: sfsfh.FILEREAD, Content: []byte("wörld")},
+		{Path: "secret/app/db/keytab", Mode: sfsfh.FILEREAD, Content: []byte{0x00, 0x01, 0xff}},
+		{Path: "secret/app/db/tls", Mode: sfsfh.DIRREAD},
+	}
+	tables := []struct {
+		suffix string
+		want   map[string]string
+	}{
+		{".b64", map[string]string{"password": "wörld", "keytab.b64": "AAH/"}},
+		{"", map[string]string{"password": "wörld"}},
+	}
+
+	for _, table := range tables {
+		got := formatKeys(subs, table.suffix)
+		if !reflect.DeepEqual(got, table.want) {
+			t.Errorf("keys with suffix %q were incorrect, got: %v, want: %v.", table.suffix, got, table.want)
+		}
+	}
+}
+
+// readCountingStore is a mapStore counting the secrets read
+type readCountingStore struct {
+	mapStore
+	reads *int
+}
+
+func (s readCountingStore) GetSecret(spath string, ctx context.Context) (*store.Secret, error) {
+	*s.reads++
+	return s.mapStore.GetSecret(spath, ctx)
+}
+
+func TestFormatsReaddir(t *testing.T) {
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	sto := readCountingStore{newMapStore(), new(int)}
+	sto.mapStore["secret/app/empty"] = &store.Secret{Path: "secret/app/empty", Mode: sfsfh.DIRREAD, HasKeys: true}
+	sto.mapStore["secret/app"] = &store.Secret{Path: "secret/app", Mode: sfsfh.DIRREAD, Subs: []*store.Secret{
+		{Path: "secret/app/tls", Mode: sfsfh.DIRREAD},
+		{Path: "secret/app/name", Mode: sfsfh.FILEREAD, Content: []byte("app")},
+		{Path: "secret/app/db", Mode: sfsfh.DIRREAD, HasKeys: true},
+		{Path: "secret/app/empty", Mode: sfsfh.DIRREAD, HasKeys: true},
+	}}
+	store.SetStore(sto)
+
+	ff := &FIOFormats{}
+	ctx := context.Background()
+	ds, errno := ff.Readdir(NewNode("/formats/secret/app"), ctx)
+	if errno != 0 {
+		t.Fatalf("listing secret/app failed: %v", errno)
+	}
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	want := []string{"db", "db.env", "db.json", "db.properties", "db.yaml", "empty", "empty.env", "empty.json", "empty.properties", "empty.yaml", "tls"}
+	if !reflect.DeepEqual(names, want) || *sto.reads != 1 {
+		t.Errorf("listing secret/app was incorrect, got: %v, %d reads, want: %v, 1 read.", names, *sto.reads, want)
+	}
+
+	tables := []struct {
+		secpath string
+		keys    int
+		errno   syscall.Errno
+	}{
+		{"secret/app/db", 3, 0},
+		{"secret/app/empty", 0, 0},
+		{"secret/app/tls", 0, syscall.ENOENT},
+	}
+
+	for _, table := range tables {
+		keys, errno := ff.keys(ctx, table.secpath)
+		if len(keys) != table.keys || errno != table.errno {
+			t.Errorf("keys of %s were incorrect, got: %v, %v, want: %d keys, %v.", table.secpath, keys, errno, table.keys, table.errno)
+		}
+	}
+}
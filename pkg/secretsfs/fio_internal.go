@@ -30,7 +30,6 @@ type internalNode struct {
 	path          string
 	isfile        bool
 	needPrivilege bool
-	filemode      uint32
 	getContent    func(context.Context) []byte
 }
 type internalNodes struct {
@@ -39,19 +38,19 @@ type internalNodes struct {
 
 var internalnodes = internalNodes{
 	[]*internalNode{
-		{"/internal", false, false, 0755, nil},
-		{"/internal/inodes", true, true, 0750, prettyprintInodes},
-		{"/internal/user", true, false, 0755, prettyprintUser},
-		{"/internal/privileged", true, false, 0755, prettyprintIsPrivileged},
-		{"/internal/store", false, false, 0755, nil},
-		{"/internal/store/vault_kv", true, true, 0750, prettyprintVault},
-		{"/internal/store/useroverrides", true, true, 0750, prettyprintUseroverrides},
-		{"/internal/store/useroverride", true, false, 0755, prettyprintUseroverride},
+		{"/internal", false, false, nil},
+		{"/internal/inodes", true, true, prettyprintInodes},
+		{"/internal/user", true, false, prettyprintUser},
+		{"/internal/privileged", true, false, prettyprintIsPrivileged},
+		{"/internal/store", false, false, nil},
+		{"/internal/store/vault_kv", true, true, prettyprintVault},
+		{"/internal/store/useroverrides", true, true, prettyprintUseroverrides},
+		{"/internal/store/useroverride", true, false, prettyprintUseroverride},
 	},
 }
 
 func prettyprintInodes(ctx context.Context) []byte {
-	content, err := PrettyPrint(pathsInodes)
+	content, err := PrettyPrint(inodes.snapshot())
 	if err != nil {
 		return []byte(fmt.Sprintf("got error on prettyprinting, err=\"%v\"\n", err))
 	}
@@ -75,14 +74,15 @@ func prettyprintIsPrivileged(ctx context.Context) []byte {
 }
 
 func prettyprintVault(ctx context.Context) []byte {
-	if s := *store.GetStore(); s.String() != "vault_kv" {
-		return []byte(fmt.Sprintf("vault is not the configured store, currently configured store: \"%v\"\n", s.String()))
+	s, ok := store.Unwrap(*store.GetStore()).(*store.VaultKv)
+	if !ok {
+		return []byte(fmt.Sprintf("vault is not the configured store, currently configured store: \"%v\"\n", (*store.GetStore()).String()))
 	}
-	pfvc, err := store.GetClient(ctx)
+	kvcs, err := s.Clients(ctx)
 	if err != nil {
-		return []byte(fmt.Sprintf("got error while calling store.GetClient(ctx), err=\"%v\"\n", err))
+		return []byte(fmt.Sprintf("got error while calling s.Clients(ctx), err=\"%v\"\n", err))
 	}
-	content, err := PrettyPrint(pfvc)
+	content, err := PrettyPrint(kvcs)
 	if err != nil {
 		return []byte(fmt.Sprintf("got error on prettyprinting, err=\"%v\"\n", err))
 	}
@@ -161,7 +161,11 @@ func (t *internalNode) getMode() uint32 {
 	return fuse.S_IFDIR
 }
 
-type FIOInternal struct{}
+type FIOInternal struct {
+	FIOReadOnly
+	FIONoSymlinks
+	FIONoXattr
+}
 
 var _ = (FIORoot)((*FIOInternal)(nil))
 
@@ -224,24 +228,7 @@ func (sf *FIOInternal) Lookup(n *SfsNode, ctx context.Context, name string, out
 		"inode":      GetInode(in.path),
 		"mode":       in.getMode()}).Debug("log values")
 
-	// if true, then get an inode for it
-	stable := fs.StableAttr{
-		Mode: in.getMode(),
-		Ino:  GetInode(in.path),
-	}
-	log.WithFields(log.Fields{
-		"n":          n,
-		"n.npath":    n.npath,
-		"name":       name,
-		"out.NodeId": out.NodeId,
-		"in":         in,
-		"inode":      GetInode(in.path),
-		"mode":       in.getMode(),
-		"stable":     stable}).Debug("log values")
-	operations := NewNode(filepath.Join(n.npath, name))
-	child := n.NewInode(ctx, operations, stable)
-	out.NodeId = GetInode(in.path)
-	return child, fs.OK
+	return newChildInode(n, ctx, in.path, in.getMode(), out), fs.OK
 }
 
 //Opener
@@ -250,7 +237,12 @@ func (sf *FIOInternal) Open(n *SfsNode, ctx context.Context, flags uint32) (fh f
 	if in.needPrivilege && !isPrivileged(ctx) {
 		return nil, 0, syscall.EPERM
 	}
-	return nil, 0, 0
+	if !in.isfile {
+		return nil, 0, 0
+	}
+	// the content is generated on every open, so its size may differ from the
+	// one reported before opening
+	return newContentHandle(in.getContent(ctx)), fuse.FOPEN_DIRECT_IO, fs.OK
 }
 
 //Reader
@@ -260,8 +252,11 @@ func (sf *FIOInternal) Read(n *SfsNode, ctx context.Context, f fs.FileHandle, de
 	if in.needPrivilege && !isPrivileged(ctx) {
 		return nil, syscall.EPERM
 	}
+	if h, ok := f.(*contentHandle); ok {
+		return h.read(dest, off), fs.OK
+	}
 	content := in.getContent(ctx)
-	results := fuse.ReadResultData(content)
+	results := fuse.ReadResultData(readAt(content, dest, off))
 	log.WithFields(log.Fields{
 		"n":       n,
 		"n.npath": n.npath,
@@ -296,10 +291,17 @@ func (sf *FIOInternal) Getattr(n *SfsNode, ctx context.Context, fh fs.FileHandle
 	//	return syscall.EISDIR
 	//}
 
-	if in.isfile {
+	// unprivileged users may neither read nor see the size of privileged nodes
+	if in.needPrivilege && !isPrivileged(ctx) {
+		out.Mode &^= 0777
+		out.Ino = GetInode(n.npath)
+		return fs.OK
+	}
+
+	// open files get their size from the filehandle
+	if in.isfile && fh == nil {
 		out.Size = uint64(len(in.getContent(ctx)))
 	}
-	out.Mode = in.filemode
 	out.Ino = GetInode(n.npath)
 	return fs.OK
 }
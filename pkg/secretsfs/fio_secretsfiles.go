@@ -1,14 +1,20 @@
 package secretsfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
 	"github.com/muryoutaisuu/secretsfs/pkg/store"
@@ -16,6 +22,15 @@ import (
 
 type FIOSecretsFiles struct{}
 
+// aliasPrefix marks keys referring to another secret, e.g. a key with the
+// value "@ref:mount/path/to/key" is displayed as symlink to that key.
+const aliasPrefix = "@ref:"
+
+// maxKeySize limits the size of keys, so that truncate(2) and writes at large
+// offsets don't allocate huge buffers. Vault limits the size of requests to
+// 32 MiB by default.
+const maxKeySize = 32 << 20
+
 var _ = (FIORoot)((*FIOSecretsFiles)(nil))
 
 func (sf *FIOSecretsFiles) Readdir(n *SfsNode, ctx context.Context) (out fs.DirStream, errno syscall.Errno) {
@@ -26,10 +41,10 @@ func (sf *FIOSecretsFiles) Readdir(n *SfsNode, ctx context.Context) (out fs.DirS
 	sec, err := sto.GetSecret(secpath, ctx)
 	if err != nil {
 		log.WithFields(log.Fields{"secpath": secpath, "error": err, "calling": "sto.GetSecret(secpath, ctx)"}).Error("Got error while getting secret")
-		return nil, syscall.ENOENT
+		return nil, errnoFromError(err)
 	}
 	if !sfsfh.IsDir(sec.Mode) {
-		log.WithFields(log.Fields{"secpath": secpath, "secret": sec, "sec.Mode": strconv.FormatInt(int64(sec.Mode), 16)}).Debug("secret is not a directory type")
+		log.WithFields(log.Fields{"secpath": secpath, "secret": sec, "sec.Mode": strconv.FormatInt(int64(sec.Mode), 8)}).Debug("secret is not a directory type")
 		return nil, syscall.ENOTDIR
 	}
 
@@ -47,7 +62,7 @@ func (sf *FIOSecretsFiles) Readdir(n *SfsNode, ctx context.Context) (out fs.DirS
 		direntries = append(direntries, fuse.DirEntry{
 			Name: filepath.Base(fixedpath),
 			Ino:  GetInode(fixedpath),
-			Mode: uint32(v.Mode),
+			Mode: aliasMode(v),
 		})
 	}
 	log.WithFields(log.Fields{"direntries": direntries}).Debug("log values")
@@ -66,30 +81,30 @@ func (sf *FIOSecretsFiles) Lookup(n *SfsNode, ctx context.Context, name string,
 	_, secpath := rootName(n.npath)
 	fullname := filepath.Join(secpath, name)
 	sec, err := sto.GetSecret(fullname, ctx)
-	if err != nil {
+	if errors.Is(err, store.ErrPermissionDenied) {
+		// a path may not be readable, while secrets below it are, so it must
+		// still be possible to traverse it
 		log.WithFields(log.Fields{
 			"calling":  "sto.GetSecret(fullname, ctx)",
 			"fullname": fullname,
 			"n":        n,
 			"n.npath":  n.npath,
 			"name":     name,
-			"error":    err}).Warn("got error while getting secret, probably not enough permissions")
-		//return nil, syscall.EPERM
-		sec = &store.Secret{Path: fullname, Mode: sfsfh.DIRNOREAD, Content: "", Subs: nil}
+			"error":    err}).Warn("not enough permissions for reading secret, displaying it as not readable directory")
+		sec = &store.Secret{Path: fullname, Mode: sfsfh.DIRNOREAD, Subs: nil}
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"calling":  "sto.GetSecret(fullname, ctx)",
+			"fullname": fullname,
+			"n":        n,
+			"n.npath":  n.npath,
+			"name":     name,
+			"error":    err}).Warn("got error while getting secret")
+		return nil, errnoFromError(err)
 	}
 	prefixedfullname := sf.prefixPath(fullname)
-	log.WithFields(log.Fields{"inode": GetInode(prefixedfullname), "mode": strconv.FormatInt(int64(sec.Mode), 16)}).Debug("log values")
-
-	// if true, then get an inode for it
-	stable := fs.StableAttr{
-		Mode: uint32(sec.Mode),
-		Ino:  GetInode(prefixedfullname),
-	}
-	log.WithFields(log.Fields{"stable": stable}).Debug("log values")
-	operations := NewNode(prefixedfullname)
-	child := n.NewInode(ctx, operations, stable)
-	out.NodeId = GetInode(prefixedfullname)
-	return child, fs.OK
+	log.WithFields(log.Fields{"prefixedfullname": prefixedfullname, "mode": strconv.FormatInt(int64(sec.Mode), 8)}).Debug("log values")
+	return newChildInode(n, ctx, prefixedfullname, aliasMode(sec), out), fs.OK
 }
 
 func (sf *FIOSecretsFiles) Open(n *SfsNode, ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
@@ -97,20 +112,59 @@ func (sf *FIOSecretsFiles) Open(n *SfsNode, ctx context.Context, flags uint32) (
 		"n":       n,
 		"n.npath": n.npath,
 		"flags":   strconv.FormatInt(int64(flags), 16)}).Debug("log values")
-	return nil, 0, 0
+	writing := flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0
+	if writing && !sf.writable() {
+		return nil, 0, syscall.EROFS
+	}
+
+	_, secpath := rootName(n.npath)
+	h := &secretHandle{spath: secpath, append: flags&syscall.O_APPEND != 0, opener: openerContext(ctx)}
+	// keys the user opened for writing before may not be committed yet
+	if content, ok := writeHandles.content(secpath, ctx); ok {
+		if !writing {
+			return newContentHandle(content), 0, fs.OK
+		}
+		h.content = content
+		writeHandles.add(h)
+		return h, 0, fs.OK
+	}
+	sto := *store.GetStore()
+	sec, err := sto.GetSecret(secpath, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting secret")
+		return nil, 0, errnoFromError(err)
+	}
+	if !sfsfh.IsFile(sec.Mode) {
+		return nil, 0, syscall.EISDIR
+	}
+	// files opened read only get a snapshot of the secret
+	if !writing {
+		return newContentHandle(sec.Content), 0, fs.OK
+	}
+	h.content = sec.Content
+	writeHandles.add(h)
+	return h, 0, fs.OK
 }
 
 func (sf *FIOSecretsFiles) Read(n *SfsNode, ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 
+	switch h := f.(type) {
+	case *contentHandle:
+		return h.read(dest, off), fs.OK
+	case *secretHandle:
+		// files opened for writing are read from their buffer
+		return fuse.ReadResultData(h.read(dest, off)), fs.OK
+	}
+
 	sto := *store.GetStore()
 	_, secpath := rootName(n.npath)
 	sec, err := sto.GetSecret(secpath, ctx)
 	if err != nil {
 		log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting secret")
-		return nil, syscall.ENOENT
+		return nil, errnoFromError(err)
 	}
-	results := fuse.ReadResultData([]byte(sec.Content))
+	results := fuse.ReadResultData(readAt(sec.Content, dest, off))
 	log.WithFields(log.Fields{"results": results}).Debug("log values")
 	return results, fs.OK
 }
@@ -121,34 +175,379 @@ func (sf *FIOSecretsFiles) Getattr(n *SfsNode, ctx context.Context, fh fs.FileHa
 		"n.npath":             n.npath,
 		"IsRootPath(n.npath)": IsRootPath(n.npath)}).Debug("log values")
 
+	if sf.writable() {
+		out.Mode |= 0200
+	}
+
 	// if rootpath, then no store is needed
 	if IsRootPath(n.npath) {
 		out.Ino = GetInode(n.npath)
 		return fs.OK
 	}
 
-	sto := *store.GetStore()
+	// open files get their size from the filehandle
+	if fh != nil {
+		out.Ino = GetInode(n.npath)
+		return fs.OK
+	}
+
+	// keys opened for writing may not be committed yet
 	_, secpath := rootName(n.npath)
+	if content, ok := writeHandles.content(secpath, ctx); ok {
+		out.Size = uint64(len(content))
+		out.Ino = GetInode(n.npath)
+		return fs.OK
+	}
+
+	sto := *store.GetStore()
 	sec, err := sto.GetSecret(secpath, ctx)
-	if err != nil {
+	if errors.Is(err, store.ErrPermissionDenied) {
+		log.WithFields(log.Fields{
+			"calling": "sto.GetSecret(secpath, ctx)",
+			"secpath": secpath,
+			"n":       n,
+			"n.npath": n.npath,
+			"error":   err}).Warn("not enough permissions for reading secret")
+		sec = &store.Secret{Path: secpath, Mode: sfsfh.FILENOREAD, Subs: nil}
+	} else if err != nil {
 		log.WithFields(log.Fields{
 			"calling": "sto.GetSecret(secpath, ctx)",
 			"secpath": secpath,
 			"n":       n,
 			"n.npath": n.npath,
-			"error":   err}).Warn("got error while getting secret, probably not enough permissions")
-		sec = &store.Secret{Path: secpath, Mode: sfsfh.FILENOREAD, Content: "", Subs: nil}
-		//return syscall.ENOENT
+			"error":   err}).Warn("got error while getting secret")
+		return errnoFromError(err)
 	}
-	log.WithFields(log.Fields{"inode": GetInode(n.npath), "Mode": strconv.FormatInt(int64(sec.Mode), 16)}).Debug("log values")
+	log.WithFields(log.Fields{"inode": GetInode(n.npath), "Mode": strconv.FormatInt(int64(sec.Mode), 8)}).Debug("log values")
 
-	if sfsfh.IsFile(sec.Mode) {
+	if target, ok := aliasTarget(sec); ok {
+		out.Size = uint64(len(target))
+	} else if sfsfh.IsFile(sec.Mode) {
 		out.Size = uint64(len(sec.Content))
 	}
+	// secrets the user may not read are reported without read permissions,
+	// directories stay traversable
+	if sec.Mode&0444 == 0 {
+		out.Mode &^= 0666
+	}
 	out.Ino = GetInode(n.npath)
 	return fs.OK
 }
 
+// Create returns a filehandle for a new key, which is only committed together
+// with the content written to it, so that no empty version of the key is
+// stored first. If nothing is written, the key is committed on Release, see
+// Flush.
+func (sf *FIOSecretsFiles) Create(n *SfsNode, ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	log.WithFields(log.Fields{
+		"n":       n,
+		"n.npath": n.npath,
+		"name":    name,
+		"flags":   strconv.FormatInt(int64(flags), 16)}).Debug("log values")
+	if !sf.writable() {
+		return nil, nil, 0, syscall.EROFS
+	}
+
+	_, secpath := rootName(n.npath)
+	fullname := filepath.Join(secpath, name)
+	prefixedfullname := sf.prefixPath(fullname)
+	child := newChildInode(n, ctx, prefixedfullname, uint32(sfsfh.FILEREAD), out)
+	h := &secretHandle{spath: fullname, dirty: true, opener: openerContext(ctx)}
+	writeHandles.add(h)
+	return child, h, 0, fs.OK
+}
+
+func (sf *FIOSecretsFiles) Write(n *SfsNode, ctx context.Context, f fs.FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "off": off}).Debug("log values")
+	h, ok := f.(*secretHandle)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	return h.write(data, off)
+}
+
+// Setattr only supports changing the size of keys. Modes, owners and times
+// can't be stored and are ignored.
+func (sf *FIOSecretsFiles) Setattr(n *SfsNode, ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	if !sf.writable() {
+		return syscall.EROFS
+	}
+
+	if size, ok := in.GetSize(); ok {
+		if size > maxKeySize {
+			return syscall.EFBIG
+		}
+		if h, ok := f.(*secretHandle); ok {
+			h.truncate(int64(size))
+		} else {
+			// The kernel truncates files opened with O_TRUNC this way, as
+			// go-fuse doesn't support atomic O_TRUNC. So keys the user
+			// opened for writing are only truncated in their buffers and
+			// committed later, truncate(2) of other keys is committed
+			// immediately.
+			_, secpath := rootName(n.npath)
+			if writeHandles.truncate(secpath, int64(size), ctx) {
+				return fs.OK
+			}
+			sto := *store.GetStore()
+			sec, err := sto.GetSecret(secpath, ctx)
+			if err != nil {
+				log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting secret")
+				return errnoFromError(err)
+			}
+			if !sfsfh.IsFile(sec.Mode) {
+				return syscall.EISDIR
+			}
+			sec.Content = resize(sec.Content, int64(size))
+			if err := sto.PutSecret(sec, ctx); err != nil {
+				log.WithFields(log.Fields{"calling": "sto.PutSecret(sec, ctx)", "secpath": secpath, "error": err}).Error("got error while truncating key")
+				return errnoFromError(err)
+			}
+		}
+	}
+	return fs.OK
+}
+
+func (sf *FIOSecretsFiles) Unlink(n *SfsNode, ctx context.Context, name string) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	return sf.delete(n, ctx, name, sfsfh.FILEREAD)
+}
+
+func (sf *FIOSecretsFiles) Mkdir(n *SfsNode, ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	if !sf.writable() {
+		return nil, syscall.EROFS
+	}
+
+	sto := *store.GetStore()
+	_, secpath := rootName(n.npath)
+	fullname := filepath.Join(secpath, name)
+	err := sto.PutSecret(&store.Secret{Path: fullname, Mode: sfsfh.DIRREAD}, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.PutSecret(sec, ctx)", "fullname": fullname, "error": err}).Error("got error while creating secret")
+		return nil, errnoFromError(err)
+	}
+
+	prefixedfullname := sf.prefixPath(fullname)
+	child := newChildInode(n, ctx, prefixedfullname, uint32(sfsfh.DIRREAD), out)
+	out.Attr.Mode = uint32(sfsfh.DIRREAD)
+	return child, fs.OK
+}
+
+func (sf *FIOSecretsFiles) Rmdir(n *SfsNode, ctx context.Context, name string) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	return sf.delete(n, ctx, name, sfsfh.DIRREAD)
+}
+
+// Flush commits the content written to the filehandle, if it was changed.
+// Keys that were only created or truncated are committed on Release, as
+// shells flush the filehandle of redirections before writing to it, e.g.
+// bash closes the file after duplicating it for echo -n v > key. Errors of
+// Release are only logged, so for them Flush returns whether the user may
+// write the key at all. Other errors of the commit on Release are lost.
+func (sf *FIOSecretsFiles) Flush(n *SfsNode, ctx context.Context, f fs.FileHandle) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	h, ok := f.(*secretHandle)
+	if !ok {
+		return fs.OK
+	}
+	if err := h.checkPending(ctx); err != nil {
+		log.WithFields(log.Fields{"calling": "h.checkPending(ctx)", "spath": h.spath, "error": err}).Error("may not write key")
+		return errnoFromError(err)
+	}
+	if err := h.commit(ctx, true); err != nil {
+		log.WithFields(log.Fields{"calling": "h.commit(ctx)", "spath": h.spath, "error": err}).Error("got error while writing key")
+		return errnoFromError(err)
+	}
+	return fs.OK
+}
+
+// xattrPrefix prefixes the metadata of secrets in the names of extended
+// attributes, e.g. user.vault.version
+const xattrPrefix = "user.vault."
+
+// flags of setxattr(2), missing in package syscall
+const (
+	xattrCreate  = 0x1 // fail if the attribute exists
+	xattrReplace = 0x2 // fail if the attribute doesn't exist
+)
+
+// Getxattr returns the metadata of the secret as extended attribute
+func (sf *FIOSecretsFiles) Getxattr(n *SfsNode, ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "attr": attr}).Debug("log values")
+	if !strings.HasPrefix(attr, xattrPrefix) {
+		return 0, syscall.ENODATA
+	}
+	md, errno := sf.metadata(n, ctx)
+	if errno != fs.OK {
+		return 0, errno
+	}
+	value, ok := md[strings.TrimPrefix(attr, xattrPrefix)]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	return xattrValue([]byte(value), dest)
+}
+
+// Listxattr lists the metadata of the secret as extended attributes
+func (sf *FIOSecretsFiles) Listxattr(n *SfsNode, ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	md, errno := sf.metadata(n, ctx)
+	if errno != fs.OK {
+		return 0, errno
+	}
+	names := make([]string, 0, len(md))
+	for k := range md {
+		names = append(names, xattrPrefix+k)
+	}
+	sort.Strings(names)
+	var list []byte
+	for _, name := range names {
+		list = append(append(list, name...), 0)
+	}
+	return xattrValue(list, dest)
+}
+
+// Setxattr sets custom metadata of the secret, e.g.
+// user.vault.custom_metadata.owner. Needs fio.secretsfiles.writable.
+func (sf *FIOSecretsFiles) Setxattr(n *SfsNode, ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "attr": attr, "flags": flags}).Debug("log values")
+	if !strings.HasPrefix(attr, xattrPrefix) {
+		return syscall.ENOTSUP
+	}
+	if !sf.writable() {
+		return syscall.EROFS
+	}
+	if flags&(xattrCreate|xattrReplace) != 0 {
+		md, errno := sf.metadata(n, ctx)
+		if errno != fs.OK {
+			return errno
+		}
+		_, exists := md[strings.TrimPrefix(attr, xattrPrefix)]
+		if exists && flags&xattrCreate != 0 {
+			return syscall.EEXIST
+		}
+		if !exists && flags&xattrReplace != 0 {
+			return syscall.ENODATA
+		}
+	}
+	sto := *store.GetStore()
+	sec := sf.metadataSecret(n)
+	if err := sto.PutMetadata(sec, strings.TrimPrefix(attr, xattrPrefix), string(data), ctx); err != nil {
+		log.WithFields(log.Fields{"calling": "sto.PutMetadata(sec, name, value, ctx)", "spath": sec.Path, "attr": attr, "error": err}).Error("got error while setting metadata")
+		return errnoFromError(err)
+	}
+	return fs.OK
+}
+
+// Removexattr removes custom metadata of the secret. Needs
+// fio.secretsfiles.writable.
+func (sf *FIOSecretsFiles) Removexattr(n *SfsNode, ctx context.Context, attr string) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "attr": attr}).Debug("log values")
+	if !strings.HasPrefix(attr, xattrPrefix) {
+		return syscall.ENODATA
+	}
+	if !sf.writable() {
+		return syscall.EROFS
+	}
+	sto := *store.GetStore()
+	sec := sf.metadataSecret(n)
+	err := sto.DeleteMetadata(sec, strings.TrimPrefix(attr, xattrPrefix), ctx)
+	if errors.Is(err, store.ErrNotFound) {
+		return syscall.ENODATA
+	} else if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.DeleteMetadata(sec, name, ctx)", "spath": sec.Path, "attr": attr, "error": err}).Error("got error while removing metadata")
+		return errnoFromError(err)
+	}
+	return fs.OK
+}
+
+// metadata returns the metadata of the secret n
+func (sf *FIOSecretsFiles) metadata(n *SfsNode, ctx context.Context) (store.Metadata, syscall.Errno) {
+	sto := *store.GetStore()
+	sec := sf.metadataSecret(n)
+	md, err := sto.GetMetadata(sec, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetMetadata(sec, ctx)", "spath": sec.Path, "error": err}).Error("got error while getting metadata")
+		return nil, errnoFromError(err)
+	}
+	return md, fs.OK
+}
+
+// metadataSecret returns the secret n for requesting its metadata from the
+// store
+func (sf *FIOSecretsFiles) metadataSecret(n *SfsNode) *store.Secret {
+	_, secpath := rootName(n.npath)
+	mode := int64(sfsfh.FILEREAD)
+	if n.IsDir() {
+		mode = sfsfh.DIRREAD
+	}
+	return &store.Secret{Path: secpath, Mode: mode}
+}
+
+// delete deletes the key or secret name inside of n
+func (sf *FIOSecretsFiles) delete(n *SfsNode, ctx context.Context, name string, mode int64) syscall.Errno {
+	if !sf.writable() {
+		return syscall.EROFS
+	}
+	sto := *store.GetStore()
+	_, secpath := rootName(n.npath)
+	fullname := filepath.Join(secpath, name)
+	if err := sto.DeleteSecret(&store.Secret{Path: fullname, Mode: mode}, ctx); err != nil {
+		log.WithFields(log.Fields{"calling": "sto.DeleteSecret(sec, ctx)", "fullname": fullname, "error": err}).Error("got error while deleting secret")
+		return errnoFromError(err)
+	}
+	return fs.OK
+}
+
+// Readlink returns the target of alias keys, see aliasTarget
+func (sf *FIOSecretsFiles) Readlink(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	sto := *store.GetStore()
+	_, secpath := rootName(n.npath)
+	sec, err := sto.GetSecret(secpath, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting secret")
+		return nil, errnoFromError(err)
+	}
+	target, ok := aliasTarget(sec)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return []byte(target), fs.OK
+}
+
+// aliasMode returns the mode of sec, alias keys are symlinks
+func aliasMode(sec *store.Secret) uint32 {
+	if _, ok := aliasTarget(sec); ok {
+		return sfsfh.SYMLINK
+	}
+	return uint32(sec.Mode)
+}
+
+// aliasTarget returns the target of the symlink of an alias key. The referred
+// path starts with the name of the mount like in secretsfiles, the target is
+// relative to the key, so it resolves inside of the mount.
+func aliasTarget(sec *store.Secret) (string, bool) {
+	if !sfsfh.IsFile(sec.Mode) || !bytes.HasPrefix(sec.Content, []byte(aliasPrefix)) {
+		return "", false
+	}
+	sep := string(filepath.Separator)
+	ref := strings.TrimSpace(string(sec.Content[len(aliasPrefix):]))
+	target, err := filepath.Rel(filepath.Dir(filepath.Join(sep, sec.Path)), filepath.Join(sep, ref))
+	if err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+// writable returns whether writing secrets is enabled with
+// fio.secretsfiles.writable
+func (sf *FIOSecretsFiles) writable() bool {
+	return viper.GetBool("fio.secretsfiles.writable")
+}
+
 func (sf *FIOSecretsFiles) FIOPath() string {
 	return "secretsfiles"
 }
@@ -157,6 +556,201 @@ func (sf *FIOSecretsFiles) prefixPath(npath string) string {
 	return string(filepath.Separator) + filepath.Join(sf.FIOPath(), npath)
 }
 
+// secretHandle is the filehandle of a key opened for writing. Writes are
+// buffered and committed as a whole on Flush, so that the key is never stored
+// partially written.
+type secretHandle struct {
+	mu      sync.Mutex
+	spath   string
+	content []byte
+	dirty   bool            // content was changed since the last commit
+	written bool            // content was written since the last commit
+	append  bool            // opened with O_APPEND, all writes go to the end
+	opener  context.Context // of the user opening the key, for commits on Release
+}
+
+// openerContext returns the caller of ctx, which stays valid after the
+// operation returned. The kernel doesn't send the caller on release.
+func openerContext(ctx context.Context) context.Context {
+	if fc, ok := ctx.(*fuse.Context); ok {
+		return &fuse.Context{Caller: fc.Caller}
+	}
+	return ctx
+}
+
+// read returns the buffered content starting at off
+func (h *secretHandle) read(dest []byte, off int64) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// copy, as the buffer may be changed by following writes
+	return append([]byte(nil), readAt(h.content, dest, off)...)
+}
+
+// write writes data to the buffered content at off, up to maxKeySize
+func (h *secretHandle) write(data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the kernel calculates the offset of appending writes from the size it
+	// knows, which may be outdated
+	if h.append {
+		off = int64(len(h.content))
+	}
+	if off < 0 || off+int64(len(data)) > maxKeySize {
+		return 0, syscall.EFBIG
+	}
+	if end := off + int64(len(data)); end > int64(len(h.content)) {
+		h.content = resize(h.content, end)
+	}
+	copy(h.content[off:], data)
+	h.dirty = true
+	h.written = true
+	return uint32(len(data)), fs.OK
+}
+
+// truncate changes the size of the buffered content
+func (h *secretHandle) truncate(size int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.content = resize(h.content, size)
+	h.dirty = true
+}
+
+// Getattr reports the size of the buffered content, which may not be
+// committed yet
+var _ = (fs.FileGetattrer)((*secretHandle)(nil))
+
+func (h *secretHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out.Size = uint64(len(h.content))
+	return fs.OK
+}
+
+// Release commits keys that were only created or truncated and drops the
+// buffered content, written content was already committed by Flush
+var _ = (fs.FileReleaser)((*secretHandle)(nil))
+
+func (h *secretHandle) Release(ctx context.Context) syscall.Errno {
+	// the kernel doesn't wait for releases, so the key is only forgotten
+	// after being committed
+	defer writeHandles.remove(h)
+	if err := h.commit(h.opener, false); err != nil {
+		log.WithFields(log.Fields{"calling": "h.commit(h.opener, false)", "spath": h.spath, "error": err}).Error("got error while writing key")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.content = nil
+	return fs.OK
+}
+
+// writeHandles contains all secretHandles of keys opened for writing
+var writeHandles = &secretHandles{handles: make(map[string]map[*secretHandle]struct{})}
+
+// secretHandles contains secretHandles mapped to the paths of their keys
+type secretHandles struct {
+	mu      sync.Mutex
+	handles map[string]map[*secretHandle]struct{}
+}
+
+func (hs *secretHandles) add(h *secretHandle) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.handles[h.spath] == nil {
+		hs.handles[h.spath] = make(map[*secretHandle]struct{})
+	}
+	hs.handles[h.spath][h] = struct{}{}
+}
+
+func (hs *secretHandles) remove(h *secretHandle) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	delete(hs.handles[h.spath], h)
+	if len(hs.handles[h.spath]) == 0 {
+		delete(hs.handles, h.spath)
+	}
+}
+
+// truncate truncates the buffers of the secretHandles of the key spath opened
+// by the caller of ctx and returns whether there were any
+func (hs *secretHandles) truncate(spath string, size int64, ctx context.Context) bool {
+	owner, ok := sfsfh.GetOwnerFromContext(ctx)
+	if !ok {
+		return false
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	found := false
+	for h := range hs.handles[spath] {
+		if o, _ := sfsfh.GetOwnerFromContext(h.opener); o == owner {
+			h.truncate(size)
+			found = true
+		}
+	}
+	return found
+}
+
+// content returns a copy of the buffered content of a secretHandle of the key
+// spath opened by the caller of ctx, preferring content which isn't committed
+// yet, if there is any. Other users must read the key from the store, which
+// checks their permissions.
+func (hs *secretHandles) content(spath string, ctx context.Context) ([]byte, bool) {
+	owner, ok := sfsfh.GetOwnerFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	var content []byte
+	found := false
+	for h := range hs.handles[spath] {
+		if o, _ := sfsfh.GetOwnerFromContext(h.opener); o != owner {
+			continue
+		}
+		h.mu.Lock()
+		if !found || h.dirty {
+			content = append([]byte{}, h.content...)
+			found = true
+		}
+		dirty := h.dirty
+		h.mu.Unlock()
+		if dirty {
+			break
+		}
+	}
+	return content, found
+}
+
+// checkPending returns whether the caller of ctx may write the key, if it
+// was only created or truncated and will be committed on Release
+func (h *secretHandle) checkPending(ctx context.Context) error {
+	h.mu.Lock()
+	pending := h.dirty && !h.written
+	h.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	sto := *store.GetStore()
+	return store.CheckWrite(sto, &store.Secret{Path: h.spath, Mode: sfsfh.FILEREAD}, ctx)
+}
+
+// commit writes the buffered content to the store, if it was changed. With
+// written only content that was written to is committed.
+func (h *secretHandle) commit(ctx context.Context, written bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty || written && !h.written {
+		return nil
+	}
+	sto := *store.GetStore()
+	err := sto.PutSecret(&store.Secret{Path: h.spath, Mode: sfsfh.FILEREAD, Content: h.content}, ctx)
+	if err != nil {
+		return err
+	}
+	h.dirty = false
+	h.written = false
+	return nil
+}
+
 func init() {
 	fioroot := FIOSecretsFiles{}
 	fm := FIOMap{
@@ -0,0 +1,161 @@
+package secretsfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+func TestAliasTarget(t *testing.T) {
+	tables := []struct {
+		sec    store.Secret
+		target string
+		ok     bool
+	}{
+		{store.Secret{Path: "secret/app/db/pw", Mode: sfsfh.FILEREAD, Content: []byte("@ref:secret/shared/pw")}, "../../shared/pw", true},
+		{store.Secret{Path: "secret/app/db/pw", Mode: sfsfh.FILEREAD, Content: []byte("@ref:secret/app/db/password\n")}, "password", true},
+		{store.Secret{Path: "secret/app/db/pw", Mode: sfsfh.FILEREAD, Content: []byte("@ref:/other/../../../pw")}, "../../../pw", true},
+		{store.Secret{Path: "secret/pw", Mode: sfsfh.FILEREAD, Content: []byte("@ref:")}, "..", true},
+		{store.Secret{Path: "secret/app/db/pw", Mode: sfsfh.FILEREAD, Content: []byte("secret")}, "", false},
+		{store.Secret{Path: "secret/app/db/pw", Mode: sfsfh.FILEREAD, Content: []byte(" @ref:secret/pw")}, "", false},
+		{store.Secret{Path: "secret/app/db", Mode: sfsfh.DIRREAD, Content: []byte("@ref:secret/pw")}, "", false},
+	}
+
+	for _, table := range tables {
+		target, ok := aliasTarget(&table.sec)
+		if target != table.target || ok != table.ok {
+			t.Errorf("aliasTarget of %q with %q was incorrect, got: %q, %v, want: %q, %v.", table.sec.Path, table.sec.Content, target, ok, table.target, table.ok)
+		}
+	}
+}
+
+// putStore is a mapStore recording the content of written keys
+type putStore struct {
+	mapStore
+	puts []string
+}
+
+func (s *putStore) PutSecret(sec *store.Secret, ctx context.Context) error {
+	s.puts = append(s.puts, string(sec.Content))
+	return nil
+}
+
+// CheckWrite denies writing keys of paths containing forbidden
+func (s *putStore) CheckWrite(sec *store.Secret, ctx context.Context) error {
+	if strings.Contains(sec.Path, "forbidden") {
+		return store.NewError(store.ErrPermissionDenied, errors.New("403"))
+	}
+	return nil
+}
+
+func TestSecretHandles(t *testing.T) {
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	sto := &putStore{mapStore: newMapStore()}
+	store.SetStore(sto)
+
+	user := func(uid uint32) context.Context {
+		return &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uid}}}
+	}
+	hs := &secretHandles{handles: make(map[string]map[*secretHandle]struct{})}
+	opened := &secretHandle{spath: "secret/key", content: []byte("old"), opener: openerContext(user(1000))}
+	created := &secretHandle{spath: "secret/new", dirty: true, opener: openerContext(user(1000))}
+	hs.add(opened)
+	hs.add(created)
+
+	tables := []struct {
+		name    string
+		change  func()
+		spath   string
+		ctx     context.Context
+		content string
+		found   bool
+		puts    int
+	}{
+		{"opened", func() {}, "secret/key", user(1000), "old", true, 0},
+		{"opened by other user", func() {}, "secret/key", user(1001), "", false, 0},
+		{"truncated by other user", func() { hs.truncate("secret/key", 1, user(1001)) }, "secret/key", user(1000), "old", true, 0},
+		{"truncated", func() { hs.truncate("secret/key", 0, user(1000)) }, "secret/key", user(1000), "", true, 0},
+		{"flushed after truncating", func() { opened.commit(user(1000), true) }, "secret/key", user(1000), "", true, 0},
+		{"written", func() { opened.write([]byte("v"), 0) }, "secret/key", user(1000), "v", true, 0},
+		{"flushed after writing", func() { opened.commit(user(1000), true) }, "secret/key", user(1000), "v", true, 1},
+		{"released after flushing", func() { opened.commit(opened.opener, false) }, "secret/key", user(1000), "v", true, 1},
+		{"created", func() {}, "secret/new", user(1000), "", true, 1},
+		{"flushed after creating", func() { created.commit(user(1000), true) }, "secret/new", user(1000), "", true, 1},
+		{"released after creating", func() { created.commit(created.opener, false) }, "secret/new", user(1000), "", true, 2},
+		{"removed", func() { hs.remove(created) }, "secret/new", user(1000), "", false, 2},
+	}
+
+	for _, table := range tables {
+		table.change()
+		content, found := hs.content(table.spath, table.ctx)
+		if string(content) != table.content || found != table.found || len(sto.puts) != table.puts {
+			t.Errorf("secret handles %s were incorrect, got: %q, %t, %d commits, want: %q, %t, %d commits.", table.name, content, found, len(sto.puts), table.content, table.found, table.puts)
+		}
+	}
+}
+
+func TestSecretHandleWrite(t *testing.T) {
+	tables := []struct {
+		content string
+		append  bool
+		data    string
+		off     int64
+		want    string
+		errno   syscall.Errno
+	}{
+		{"secret", false, "S", 0, "Secret", 0},
+		{"secret", false, "!", 6, "secret!", 0},
+		{"secret", false, "!", 7, "secret\x00!", 0},
+		{"secret", true, "!", 0, "secret!", 0},
+		{"secret", false, "!", maxKeySize - 1, "", 0},
+		{"secret", false, "!!", maxKeySize - 1, "secret", syscall.EFBIG},
+		{"secret", false, "!", 1 << 40, "secret", syscall.EFBIG},
+		{"secret", false, "!", -1, "secret", syscall.EFBIG},
+	}
+
+	for _, table := range tables {
+		h := &secretHandle{content: []byte(table.content), append: table.append}
+		written, errno := h.write([]byte(table.data), table.off)
+		if errno != table.errno || errno == 0 && written != uint32(len(table.data)) || table.want != "" && string(h.content) != table.want {
+			t.Errorf("writing %q at %d was incorrect, got: %d, %v, want: %q, %v.", table.data, table.off, written, errno, table.want, table.errno)
+		}
+	}
+}
+
+func TestFlushPending(t *testing.T) {
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	sto := &putStore{mapStore: newMapStore()}
+	store.SetStore(sto)
+
+	sf := &FIOSecretsFiles{}
+	n := NewNode("/secretsfiles/secret/app")
+	tables := []struct {
+		name  string
+		h     *secretHandle
+		errno syscall.Errno
+		puts  int
+	}{
+		{"created", &secretHandle{spath: "secret/app/new", dirty: true}, 0, 0},
+		{"created without permissions", &secretHandle{spath: "secret/forbidden/new", dirty: true}, syscall.EACCES, 0},
+		{"truncated without permissions", &secretHandle{spath: "secret/forbidden/key", content: []byte{}, dirty: true}, syscall.EACCES, 0},
+		{"opened without permissions", &secretHandle{spath: "secret/forbidden/key", content: []byte("v")}, 0, 0},
+		{"written", &secretHandle{spath: "secret/app/key", content: []byte("v"), dirty: true, written: true}, 0, 1},
+	}
+
+	for _, table := range tables {
+		sto.puts = nil
+		errno := sf.Flush(n, context.Background(), table.h)
+		if errno != table.errno || len(sto.puts) != table.puts {
+			t.Errorf("flushing %s was incorrect, got: %v, %d commits, want: %v, %d commits.", table.name, errno, len(sto.puts), table.errno, table.puts)
+		}
+	}
+}
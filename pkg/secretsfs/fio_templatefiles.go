@@ -3,10 +3,14 @@ package secretsfs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"text/template"
 
@@ -15,33 +19,228 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
 	"github.com/muryoutaisuu/secretsfs/pkg/store"
 )
 
 var TEMPLATESPATHS map[string]string
 
+// errLinkOutsideRoot is returned for symlinks pointing outside of their
+// template root.
+var errLinkOutsideRoot = errors.New("symlink target is outside of the template root")
+
+// partialsDir is the directory inside of each template root containing
+// partials, templates available in all templatefiles of the root. It is not
+// displayed in templatefiles.
+const partialsDir = "_partials"
+
+// maxIncludeDepth limits nested calls of include, so that recursive partials
+// fail instead of exhausting the stack.
+const maxIncludeDepth = 100
+
 // secret will be used to call the stores implementation of all the needed FUSE-
 // operations together with the provided flags and fuse.Context.
 type secret struct {
-	ctx *context.Context
+	ctx  *context.Context
+	deps *renderDeps // records what the content depends on, if it is cached
+}
+
+// dependsOnProcess marks the content rendered with s as specific to the
+// calling process, so that it isn't cached for other processes
+func (s secret) dependsOnProcess() {
+	if s.deps != nil {
+		s.deps.perProcess = true
+	}
+}
+
+// getSecret returns the secret spath from the store and records its version
+// for the render cache
+func (s secret) getSecret(spath string) (*store.Secret, error) {
+	sto := *store.GetStore()
+	sec, err := sto.GetSecret(spath, *s.ctx)
+	if s.deps != nil && (err == nil || errors.Is(err, store.ErrNotFound)) {
+		s.deps.read(spath, sec, *s.ctx)
+	}
+	return sec, err
 }
 
 // Get is the function that will be called from inside of the templatefile.
 // You need to use following scheme to get secrets substituted:
-//  {{ .Get "path/to/secret" }}
+//  {{ .Get "mount/path/to/secret" }}
+// The path starts with the name of the mount as displayed in secretsfiles, or
+// with the path of the mount in the store.
 func (s secret) Get(filepath string) (string, error) {
-	sto := *store.GetStore()
-	sec, err := sto.GetSecret(filepath, *s.ctx)
+	sec, err := s.getSecret(filepath)
 	if err != nil {
 		return "", err
 	}
-	if sec.Content == "" {
+	if len(sec.Content) == 0 {
 		return "", fmt.Errorf("msg=\"content of secret is empty\" secret=\"%v\"\n", filepath)
 	}
-	return sec.Content, nil
+	return string(sec.Content), nil
+}
+
+// GetAllowEmpty returns the secret like Get, but doesn't fail on empty
+// secrets:
+//  {{ .GetAllowEmpty "mount/path/to/secret" }}
+func (s secret) GetAllowEmpty(spath string) (string, error) {
+	sec, err := s.getSecret(spath)
+	if err != nil {
+		return "", err
+	}
+	return string(sec.Content), nil
+}
+
+// GetOr returns the secret like Get, or def if the secret doesn't exist or is
+// empty:
+//  {{ .GetOr "mount/path/to/secret" "default" }}
+func (s secret) GetOr(spath, def string) (string, error) {
+	sec, err := s.getSecret(spath)
+	if errors.Is(err, store.ErrNotFound) {
+		return def, nil
+	} else if err != nil {
+		return "", err
+	}
+	if len(sec.Content) == 0 {
+		return def, nil
+	}
+	return string(sec.Content), nil
+}
+
+// List returns the sorted names of the keys of a secret, e.g. for iterating
+// over them:
+//  {{ range .List "mount/path/to/secret" }}{{ . }}{{ end }}
+func (s secret) List(spath string) ([]string, error) {
+	sec, err := s.getSecret(spath)
+	if err != nil {
+		return nil, err
+	}
+	if !sfsfh.IsDir(sec.Mode) {
+		return nil, fmt.Errorf("msg=\"secret is not a directory\" secret=\"%v\"\n", spath)
+	}
+	keys := []string{}
+	for _, v := range sec.Subs {
+		if sfsfh.IsFile(v.Mode) {
+			keys = append(keys, filepath.Base(v.Path))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
 }
 
-type FIOTemplateFiles struct{}
+// Secret returns all keys of a secret mapped to their values, empty values
+// included:
+//  {{ with .Secret "mount/path/to/secret" }}{{ .user }}:{{ .password }}{{ end }}
+func (s secret) Secret(spath string) (map[string]string, error) {
+	sec, err := s.getSecret(spath)
+	if err != nil {
+		return nil, err
+	}
+	if !sfsfh.IsDir(sec.Mode) {
+		return nil, fmt.Errorf("msg=\"secret is not a directory\" secret=\"%v\"\n", spath)
+	}
+	values := make(map[string]string)
+	for _, v := range sec.Subs {
+		if sfsfh.IsFile(v.Mode) {
+			values[filepath.Base(v.Path)] = string(v.Content)
+		}
+	}
+	return values, nil
+}
+
+// Keys returns the sorted paths of the secrets below a path, e.g. for
+// rendering a section per secret:
+//  {{ range .Keys "mount/path" }}[{{ base . }}]{{ end }}
+func (s secret) Keys(spath string) ([]string, error) {
+	sec, err := s.getSecret(spath)
+	if err != nil {
+		return nil, err
+	}
+	if !sfsfh.IsDir(sec.Mode) {
+		return nil, fmt.Errorf("msg=\"secret is not a directory\" secret=\"%v\"\n", spath)
+	}
+	// listings have no versions
+	if s.deps != nil {
+		s.deps.unversioned = true
+	}
+	paths := []string{}
+	for _, v := range sec.Subs {
+		if sfsfh.IsDir(v.Mode) {
+			paths = append(paths, filepath.Join(spath, filepath.Base(v.Path)))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// templateUser is the user reading a templatefile, available in templates as
+// .User
+type templateUser struct {
+	Name   string
+	Uid    string
+	Gid    string
+	Home   string
+	Groups []string // names of all groups of the user
+}
+
+// templateCaller is the process reading a templatefile, available in
+// templates as .Caller
+type templateCaller struct {
+	Pid        uint32
+	Executable string // empty, if it can't be read
+}
+
+// User returns the user reading the templatefile, e.g. for per-user
+// configuration files:
+//  {{ .Get (printf "mount/users/%s/token" .User.Name) }}
+func (s secret) User() (*templateUser, error) {
+	if _, ok := sfsfh.GetOwnerFromContext(*s.ctx); !ok {
+		return nil, fmt.Errorf("msg=\"no user in context\"\n")
+	}
+	u, err := sfsfh.GetUserFromContext(*s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	tu := &templateUser{Name: u.Username, Uid: u.Uid, Gid: u.Gid, Home: u.HomeDir, Groups: []string{}}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, gid := range gids {
+		name := gid
+		if g, err := user.LookupGroupId(gid); err == nil {
+			name = g.Name
+		}
+		tu.Groups = append(tu.Groups, name)
+	}
+	return tu, nil
+}
+
+// Caller returns the process reading the templatefile
+func (s secret) Caller() *templateCaller {
+	s.dependsOnProcess()
+	tc := &templateCaller{}
+	if c, ok := (*s.ctx).(*fuse.Context); ok {
+		tc.Pid = c.Caller.Pid
+	}
+	tc.Executable, _ = sfsfh.GetExecutableFromContext(*s.ctx)
+	return tc
+}
+
+// Hostname returns the hostname of the host secretsfs runs on
+func (s secret) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+// MountPoint returns the path secretsfs is mounted at
+func (s secret) MountPoint() string {
+	return mountPoint
+}
+
+type FIOTemplateFiles struct {
+	FIOReadOnly
+	FIONoXattr
+}
 
 var _ = (FIORoot)((*FIOTemplateFiles)(nil))
 
@@ -73,6 +272,9 @@ func (sf *FIOTemplateFiles) Readdir(n *SfsNode, ctx context.Context) (out fs.Dir
 			return nil, syscall.ENOENT
 		}
 		for _, f := range files {
+			if isPartialsDir(utemplp, f.Name()) {
+				continue
+			}
 			direntries = append(direntries, fuse.DirEntry{
 				Name: f.Name(),
 				Ino:  GetInode(filepath.Join(n.npath, f.Name())),
@@ -97,7 +299,7 @@ func (sf *FIOTemplateFiles) Lookup(n *SfsNode, ctx context.Context, name string,
 	prefixedfullname := filepath.Join(n.npath, name)
 	// if is root template path, then
 	if _, ok := TEMPLATESPATHS[name]; ok {
-		return getLookupChild(n, prefixedfullname, fuse.S_IFDIR, ctx, out)
+		return newChildInode(n, ctx, prefixedfullname, fuse.S_IFDIR, out), fs.OK
 	}
 
 	// walk unixpaths and return their dir listings
@@ -111,21 +313,41 @@ func (sf *FIOTemplateFiles) Lookup(n *SfsNode, ctx context.Context, name string,
 		}
 		for _, f := range files {
 			// if upath listing contains the requested filename
-			if f.Name() == name {
-				return getLookupChild(n, prefixedfullname, getModeFromFileInfo(f), ctx, out)
+			if f.Name() == name && !isPartialsDir(utemplp, name) {
+				return newChildInode(n, ctx, prefixedfullname, getModeFromFileInfo(f), out), fs.OK
 			}
 		}
 	}
 	return nil, syscall.ENOENT
 }
 
+// Open renders the templatefile once, all reads of the opened file are served
+// from the rendered content. The rendered content may differ from the size
+// reported before opening, so the page cache is bypassed with direct IO.
 func (sf *FIOTemplateFiles) Open(n *SfsNode, ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	return nil, 0, 0
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	content, errno := sf.render(n, ctx)
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	return newContentHandle(content), fuse.FOPEN_DIRECT_IO, fs.OK
 }
 
 func (sf *FIOTemplateFiles) Read(n *SfsNode, ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 
+	if h, ok := f.(*contentHandle); ok {
+		return h.read(dest, off), fs.OK
+	}
+	content, errno := sf.render(n, ctx)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	return fuse.ReadResultData(readAt(content, dest, off)), fs.OK
+}
+
+// render returns the rendered templatefile of n
+func (sf *FIOTemplateFiles) render(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
 	rtemplp, utemplp := getTemplateSubPaths(n.npath) // roottemplatepath + unixtemplatepath
 	if templp, ok := TEMPLATESPATHS[rtemplp]; ok {
 		unixpath := filepath.Join(templp, utemplp)
@@ -134,7 +356,7 @@ func (sf *FIOTemplateFiles) Read(n *SfsNode, ctx context.Context, f fs.FileHandl
 			"utemplp":  utemplp,
 			"templp":   templp,
 			"unixpath": unixpath}).Debug("log values")
-		content, err := renderTemplatefile(unixpath, &ctx)
+		content, err := renderTemplatefileCached(templp, unixpath, ctx)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"rtemplp":  rtemplp,
@@ -142,10 +364,9 @@ func (sf *FIOTemplateFiles) Read(n *SfsNode, ctx context.Context, f fs.FileHandl
 				"templp":   templp,
 				"unixpath": unixpath,
 				"error":    err}).Error("got error while rendering templatefile")
-			return nil, syscall.EIO
+			return nil, errnoFromError(err)
 		}
-		results := fuse.ReadResultData([]byte(content))
-		return results, fs.OK
+		return content, fs.OK
 	}
 	return nil, syscall.ENOENT
 }
@@ -182,18 +403,25 @@ func (sf *FIOTemplateFiles) Getattr(n *SfsNode, ctx context.Context, fh fs.FileH
 			"utemplp":                 utemplp,
 			"TEMPLATESPATHS[rtemplp]": TEMPLATESPATHS[rtemplp],
 			"unixpath":                unixpath}).Debug("log values")
-		fileinfo, err := os.Stat(unixpath)
+		fileinfo, err := os.Lstat(unixpath)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"rtemplp":                 rtemplp,
 				"utemplp":                 utemplp,
 				"TEMPLATESPATHS[rtemplp]": TEMPLATESPATHS[rtemplp],
 				"unixpath":                unixpath,
-				"error":                   err}).Error("got error while performing os.Stat(unixpath)")
+				"error":                   err}).Error("got error while performing os.Lstat(unixpath)")
 			return syscall.ENOENT
 		}
-		if fileinfo.Mode().IsRegular() {
-			content, err := renderTemplatefile(unixpath, &ctx)
+		if fileinfo.Mode()&os.ModeSymlink != 0 {
+			if target, err := linkTarget(templp, utemplp); err == nil {
+				out.Size = uint64(len(target))
+			}
+		}
+		// open files get their size from the filehandle, without rendering on
+		// stat the size is reported as 0, reads use direct IO anyway
+		if fileinfo.Mode().IsRegular() && fh == nil && viper.GetBool("fio.templatefiles.renderonstat") {
+			content, err := renderTemplatefileCached(templp, unixpath, ctx)
 			if err != nil {
 				log.WithFields(log.Fields{"error": err}).Error("error while rendering templatefile for size calculation")
 			}
@@ -205,6 +433,26 @@ func (sf *FIOTemplateFiles) Getattr(n *SfsNode, ctx context.Context, fh fs.FileH
 	return syscall.ENOENT
 }
 
+// Readlink returns the target of a symlink inside of a template root, see
+// linkTarget.
+func (sf *FIOTemplateFiles) Readlink(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	rtemplp, utemplp := getTemplateSubPaths(n.npath) // roottemplatepath + unixtemplatepath
+	templp, ok := TEMPLATESPATHS[rtemplp]
+	if !ok || utemplp == "" {
+		return nil, syscall.EINVAL
+	}
+	target, err := linkTarget(templp, utemplp)
+	if errors.Is(err, errLinkOutsideRoot) {
+		log.WithFields(log.Fields{"templp": templp, "utemplp": utemplp, "error": err}).Warn("refusing to resolve symlink")
+		return nil, syscall.EACCES
+	} else if err != nil {
+		log.WithFields(log.Fields{"templp": templp, "utemplp": utemplp, "error": err}).Error("got error while reading symlink")
+		return nil, syscall.ENOENT
+	}
+	return []byte(target), fs.OK
+}
+
 func (sf *FIOTemplateFiles) FIOPath() string {
 	return "templatefiles"
 }
@@ -218,20 +466,55 @@ func getTemplateSubPaths(npath string) (rtemplp, utemplp string) {
 	return rootName(spath)      // roottemplatepath + unixtemplatepath
 }
 
-func getLookupChild(n *SfsNode, name string, mode uint32, ctx context.Context, out *fuse.EntryOut) (child *fs.Inode, errno syscall.Errno) {
-	ino := GetInode(name)
-	stable := fs.StableAttr{
-		Mode: mode,
-		Ino:  ino,
+// linkTarget returns the target of the symlink utemplp inside of the template
+// root templp. The target must be inside of templp, it is returned relative to
+// the symlink, so it also resolves inside of the mount.
+func linkTarget(templp, utemplp string) (string, error) {
+	unixpath := filepath.Join(templp, utemplp)
+	target, err := os.Readlink(unixpath)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(unixpath), target)
 	}
-	operations := NewNode(name)
-	child = n.NewInode(ctx, operations, stable)
-	out.NodeId = ino
-	return child, fs.OK
+
+	// resolve further symlinks, dangling symlinks can only be checked by
+	// their path
+	root, resolved := filepath.Clean(templp), filepath.Clean(target)
+	if r, err := filepath.EvalSymlinks(target); err == nil {
+		if root, err = filepath.EvalSymlinks(templp); err != nil {
+			return "", err
+		}
+		resolved = r
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s -> %s", errLinkOutsideRoot, unixpath, target)
+	}
+
+	sep := string(filepath.Separator)
+	return filepath.Rel(filepath.Dir(filepath.Join(sep, utemplp)), filepath.Join(sep, rel))
+}
+
+// isPartialsDir returns whether name inside of the directory utemplp of a
+// template root is the directory of partials
+func isPartialsDir(utemplp, name string) bool {
+	return utemplp == "" && name == partialsDir
+}
+
+// tpath = templatepath, templp = root of the templatepath
+// The partials of fio.templatefiles.partialspath and of the template root are
+// parsed before the templatefile, so that templatefiles may override them.
+func renderTemplatefile(templp, tpath string, context *context.Context) ([]byte, error) {
+	return executeTemplatefile(templp, tpath, secret{ctx: context})
 }
 
-// tpath = templatepath
-func renderTemplatefile(tpath string, context *context.Context) ([]byte, error) {
+// executeTemplatefile renders the templatefile tpath of the template root
+// templp with thesecret, see renderTemplatefile
+func executeTemplatefile(templp, tpath string, thesecret secret) ([]byte, error) {
 	// check whether filepath exists
 	fileinfo, err := os.Stat(tpath)
 	if err != nil {
@@ -246,7 +529,14 @@ func renderTemplatefile(tpath string, context *context.Context) ([]byte, error)
 	}
 
 	filename := filepath.Base(tpath)
-	parser, err := template.New(filename).ParseFiles(tpath)
+	parser := template.New(filename)
+	parser.Funcs(templateFuncs(thesecret, parser))
+	for _, dir := range partialsDirs(templp) {
+		if err := parsePartials(parser, dir); err != nil {
+			return nil, fmt.Errorf("msg=\"Got an error while parsing partials\" dir=\"%s\" error=\"%v\"\n", dir, err)
+		}
+	}
+	_, err = parser.ParseFiles(tpath)
 	// error handling
 	if err != nil {
 		return nil, fmt.Errorf("msg=\"Got an error while getting template\" filepath=\"%s\" filename=\"%s\" error=\"%v\"\n", tpath, filename, err)
@@ -257,10 +547,6 @@ func renderTemplatefile(tpath string, context *context.Context) ([]byte, error)
 	// https://gowalker.org/bytes#Buffer_Bytes
 	// https://stackoverflow.com/questions/23454940/getting-bytes-buffer-does-not-implement-io-writer-error-message
 	var buf bytes.Buffer
-	thesecret := secret{
-		ctx: context,
-	}
-
 	err = parser.Execute(&buf, thesecret)
 	if err != nil {
 		return nil, err
@@ -268,6 +554,46 @@ func renderTemplatefile(tpath string, context *context.Context) ([]byte, error)
 	return buf.Bytes(), err
 }
 
+// partialsDirs returns the directories containing the partials of the
+// templatefiles of the template root templp, in the order they are parsed
+func partialsDirs(templp string) []string {
+	dirs := []string{filepath.Join(templp, partialsDir)}
+	if shared := viper.GetString("fio.templatefiles.partialspath"); shared != "" {
+		dirs = append([]string{shared}, dirs...)
+	}
+	return dirs
+}
+
+// parsePartials adds all files in dir and its subdirectories as templates to t.
+// They are named by their path relative to dir, templates defined inside of
+// them are added as well. A missing dir contains no partials.
+func parsePartials(t *template.Template, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		text, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		_, err = t.New(filepath.ToSlash(name)).Parse(string(text))
+		return err
+	})
+}
+
 func generateTemplatesPaths() {
 	TEMPLATESPATHS = viper.GetStringMapString("fio.templatefiles.templatespaths")
 }
@@ -0,0 +1,237 @@
+package secretsfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+// renders caches the rendered templatefiles
+var renders = newRenderCache()
+
+// renderCache caches rendered templatefiles per calling user, so that Getattr
+// and Read don't render a templatefile twice, requesting all of its secrets
+// again. Rendered templatefiles are cached for fio.templatefiles.cache.render_ttl
+// and are outdated once the templatefile or a partial is modified, or the
+// version of a secret they read changed. Secrets without versions, e.g. of KV
+// version 1, and listings of secrets are only noticed to change if they are
+// written through the store, see store.Generation, so templatefiles depending
+// on them are only cached with the store's cache. Templatefiles depending on
+// the calling process, e.g. by using env, aren't cached either.
+type renderCache struct {
+	mu      sync.Mutex
+	entries map[renderKey]*renderEntry
+	calls   map[renderKey]*renderCall // renders in flight
+}
+
+// renderKey identifies a templatefile rendered for a user
+type renderKey struct {
+	uid   string
+	tpath string
+}
+
+// renderEntry is a rendered templatefile
+type renderEntry struct {
+	content     []byte
+	modTime     time.Time // of the templatefile and its partials when rendered
+	versions    map[string]secretVersion
+	unversioned bool   // depends on secrets without versions
+	generation  uint64 // of the store when rendered
+	expires     time.Time
+}
+
+// renderCall is a render in flight, concurrent identical renders wait for it
+// instead of rendering the templatefile again
+type renderCall struct {
+	done      chan struct{}
+	content   []byte
+	cacheable bool // the content may be used by other processes
+	err       error
+}
+
+// renderDeps records what a templatefile depends on while rendering it
+type renderDeps struct {
+	perProcess  bool // the content depends on the calling process
+	unversioned bool // secrets without versions or listings were read
+	versions    map[string]secretVersion
+}
+
+// secretVersion is the version of a secret read by a templatefile, versions
+// are mapped to the paths read
+type secretVersion struct {
+	mode    int64 // of the path read, keys have the versions of their secrets
+	version string
+}
+
+// read records the version of the secret or key sec read at spath. sec is nil,
+// if it doesn't exist.
+func (d *renderDeps) read(spath string, sec *store.Secret, ctx context.Context) {
+	mode := int64(sfsfh.FILEREAD)
+	if sec != nil {
+		mode = sec.Mode
+	}
+	version, ok := storedVersion(spath, mode, ctx)
+	if !ok {
+		d.unversioned = true
+		return
+	}
+	if d.versions == nil {
+		d.versions = make(map[string]secretVersion)
+	}
+	d.versions[spath] = secretVersion{mode: mode, version: version}
+}
+
+// storedVersion returns the current version of the secret spath or of the
+// secret containing the key spath, if it has versions
+func storedVersion(spath string, mode int64, ctx context.Context) (string, bool) {
+	sto := *store.GetStore()
+	md, err := sto.GetMetadata(&store.Secret{Path: spath, Mode: mode}, ctx)
+	if err != nil || md["version"] == "" {
+		return "", false
+	}
+	return md["version"], true
+}
+
+// valid returns whether e is still valid for the templatefile and partials
+// modified at modTime and the store at generation
+func (e *renderEntry) valid(modTime time.Time, generation uint64, hasGeneration bool, ctx context.Context) bool {
+	if !time.Now().Before(e.expires) || !e.modTime.Equal(modTime) {
+		return false
+	}
+	if e.unversioned && (!hasGeneration || e.generation != generation) {
+		return false
+	}
+	for spath, sv := range e.versions {
+		if version, ok := storedVersion(spath, sv.mode, ctx); !ok || version != sv.version {
+			return false
+		}
+	}
+	return true
+}
+
+func newRenderCache() *renderCache {
+	return &renderCache{
+		entries: make(map[renderKey]*renderEntry),
+		calls:   make(map[renderKey]*renderCall),
+	}
+}
+
+// get returns the templatefile tpath of the template root templp, if it was
+// rendered for the calling user and is still valid. Otherwise it is rendered
+// with render, which returns what the content depends on.
+func (c *renderCache) get(templp, tpath string, ctx context.Context, render func() ([]byte, *renderDeps, error)) ([]byte, error) {
+	uncached := func() ([]byte, error) {
+		content, _, err := render()
+		return content, err
+	}
+	ttl := viper.GetDuration("fio.templatefiles.cache.render_ttl")
+	fc, ok := ctx.(*fuse.Context)
+	if !ok || ttl <= 0 {
+		return uncached()
+	}
+	key := renderKey{uid: strconv.FormatUint(uint64(fc.Caller.Uid), 10), tpath: tpath}
+	modTime, err := templateModTime(templp, tpath)
+	if err != nil {
+		return uncached()
+	}
+	// taken before rendering, so that writes while rendering outdate it
+	generation, hasGeneration := store.Generation(*store.GetStore())
+
+	// the versions are checked without c.mu, as they are requested from the
+	// store
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && e.valid(modTime, generation, hasGeneration, ctx) {
+		log.WithFields(log.Fields{"uid": key.uid, "tpath": tpath}).Trace("serving rendered templatefile from cache")
+		return e.content, nil
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if !call.cacheable {
+			return uncached()
+		}
+		return call.content, call.err
+	}
+	call := &renderCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	content, deps, err := render()
+	call.content, call.err = content, err
+	// without generation changes of secrets without versions wouldn't be
+	// noticed
+	call.cacheable = deps != nil && !deps.perProcess && (!deps.unversioned || hasGeneration)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil && call.cacheable {
+		c.add(key, &renderEntry{
+			content:     call.content,
+			modTime:     modTime,
+			versions:    deps.versions,
+			unversioned: deps.unversioned,
+			generation:  generation,
+			expires:     time.Now().Add(ttl),
+		})
+	} else if old, ok := c.entries[key]; ok && old == e {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.content, call.err
+}
+
+// add caches e and removes all expired entries. Must have c.mu.
+func (c *renderCache) add(key renderKey, e *renderEntry) {
+	now := time.Now()
+	for k, old := range c.entries {
+		if !now.Before(old.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// templateModTime returns the latest modification time of the templatefile
+// tpath and of the partials it is rendered with
+func templateModTime(templp, tpath string) (time.Time, error) {
+	fi, err := os.Stat(tpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := fi.ModTime()
+	for _, dir := range partialsDirs(templp) {
+		// missing directories contain no partials
+		_ = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.ModTime().After(latest) {
+				latest = fi.ModTime()
+			}
+			return nil
+		})
+	}
+	return latest, nil
+}
+
+// renderTemplatefileCached returns the templatefile tpath of the template root
+// templp rendered by renderTemplatefile, from the cache if possible
+func renderTemplatefileCached(templp, tpath string, ctx context.Context) ([]byte, error) {
+	return renders.get(templp, tpath, ctx, func() ([]byte, *renderDeps, error) {
+		deps := &renderDeps{}
+		content, err := executeTemplatefile(templp, tpath, secret{ctx: &ctx, deps: deps})
+		return content, deps, err
+	})
+}
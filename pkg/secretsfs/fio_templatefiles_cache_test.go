@@ -0,0 +1,125 @@
+package secretsfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/spf13/viper"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+// versionedStore is a mapStore, whose secrets have the versions in versions
+type versionedStore struct {
+	mapStore
+	versions map[string]string
+}
+
+func (s *versionedStore) GetMetadata(sec *store.Secret, ctx context.Context) (store.Metadata, error) {
+	spath := sec.Path
+	if sfsfh.IsFile(sec.Mode) {
+		spath = path.Dir(spath)
+	}
+	return store.Metadata{"version": s.versions[spath]}, nil
+}
+
+// generationStore is a versionedStore counting writes like the cache
+type generationStore struct {
+	*versionedStore
+	generation uint64
+}
+
+func (s *generationStore) Generation() uint64 { return s.generation }
+
+func TestRenderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretsfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tpath := filepath.Join(dir, "app.conf")
+	partial := filepath.Join(dir, partialsDir, "db.tmpl")
+	for _, f := range []string{tpath, partial} {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	versioned := &versionedStore{mapStore: newMapStore(), versions: map[string]string{"secret/app/db": "1"}}
+	sto := &generationStore{versionedStore: versioned}
+	store.SetStore(sto)
+	defer viper.Set("fio.templatefiles.cache.render_ttl", 0)
+	viper.Set("fio.templatefiles.cache.render_ttl", time.Hour)
+
+	c := newRenderCache()
+	renders := 0
+	deps := renderDeps{unversioned: true}
+	render := func() ([]byte, *renderDeps, error) {
+		renders++
+		d := deps
+		return []byte(strconv.Itoa(renders)), &d, nil
+	}
+	user := func(uid uint32) context.Context {
+		return &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uid}}}
+	}
+	touch := func(f string, i int) {
+		mtime := time.Now().Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := []struct {
+		name   string
+		change func()
+		ctx    context.Context
+		want   string
+	}{
+		{"first render", func() {}, user(1000), "1"},
+		{"cached", func() {}, user(1000), "1"},
+		{"other user", func() {}, user(1001), "2"},
+		{"first user still cached", func() {}, user(1000), "1"},
+		{"templatefile modified", func() { touch(tpath, 1) }, user(1000), "3"},
+		{"partial modified", func() { touch(partial, 2) }, user(1000), "4"},
+		{"secret written", func() { sto.generation++ }, user(1000), "5"},
+		{"cached again", func() {}, user(1000), "5"},
+		{"without user", func() {}, context.Background(), "6"},
+		{"ttl disabled", func() { viper.Set("fio.templatefiles.cache.render_ttl", 0) }, user(1000), "7"},
+		{"ttl expired", func() { viper.Set("fio.templatefiles.cache.render_ttl", time.Nanosecond) }, user(1002), "8"},
+		{"expired again", func() {}, user(1002), "9"},
+		{"per process", func() { viper.Set("fio.templatefiles.cache.render_ttl", time.Hour); deps.perProcess = true }, user(1003), "10"},
+		{"per process again", func() {}, user(1003), "11"},
+		{"store without generation", func() { deps.perProcess = false; store.SetStore(versioned) }, user(1004), "12"},
+		{"store without generation again", func() {}, user(1004), "13"},
+		{"versioned", func() {
+			deps = renderDeps{versions: map[string]secretVersion{"secret/app/db/port": {sfsfh.FILEREAD, "1"}}}
+		}, user(1004), "14"},
+		{"versioned cached", func() {}, user(1004), "14"},
+		{"version changed", func() { versioned.versions["secret/app/db"] = "2" }, user(1004), "15"},
+		{"changed version cached", func() { deps.versions["secret/app/db/port"] = secretVersion{sfsfh.FILEREAD, "2"} }, user(1004), "15"},
+		{"versioned with generation", func() { store.SetStore(sto) }, user(1005), "16"},
+		{"versioned with generation after write", func() { sto.generation++ }, user(1005), "16"},
+		{"secret deleted", func() { delete(versioned.versions, "secret/app/db") }, user(1005), "17"},
+	}
+
+	for _, table := range tables {
+		table.change()
+		content, err := c.get(dir, tpath, table.ctx, render)
+		if err != nil || string(content) != table.want {
+			t.Errorf("render cache %s was incorrect, got: %q, %v, want: %q.", table.name, content, err, table.want)
+		}
+	}
+}
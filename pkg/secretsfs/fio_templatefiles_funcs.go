@@ -0,0 +1,130 @@
+package secretsfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
+)
+
+// templateFuncs returns the functions available in templatefiles. Functions
+// accessing the store are bound to s, so they use the context of the calling
+// user, include renders the templates of t.
+func templateFuncs(s secret, t *template.Template) template.FuncMap {
+	return template.FuncMap{
+		// store
+		"Get":           s.Get,
+		"GetAllowEmpty": s.GetAllowEmpty,
+		"GetOr":         s.GetOr,
+		"List":          s.List,
+		"Secret":        s.Secret,
+		"Keys":          s.Keys,
+		"env":           s.env,
+
+		// templates
+		"include": include(t),
+
+		// encoding
+		"b64enc": b64enc,
+		"b64dec": b64dec,
+		"toJson": toJson,
+		"quote":  strconv.Quote,
+		"sha256": sha256sum,
+
+		// strings
+		"base":   path.Base,
+		"indent": indent,
+		"trim":   strings.TrimSpace,
+		"upper":  strings.ToUpper,
+		"lower":  strings.ToLower,
+
+		// checks
+		"required": required,
+	}
+}
+
+// env returns the environment variable name of the process reading the
+// templatefile, or an empty string if it isn't set
+func (s secret) env(name string) (string, error) {
+	s.dependsOnProcess()
+	value, _, err := sfsfh.GetEnvFromContext(*s.ctx, name)
+	return value, err
+}
+
+// include returns a function rendering the template name of t, so that the
+// result can be piped into other functions:
+//
+//	{{ include "db" . | indent 2 }}
+func include(t *template.Template) func(string, interface{}) (string, error) {
+	depth := 0
+	return func(name string, data interface{}) (string, error) {
+		if depth >= maxIncludeDepth {
+			return "", fmt.Errorf("msg=\"exceeded maximal depth of include\" template=\"%s\"\n", name)
+		}
+		depth++
+		defer func() { depth-- }()
+		var buf bytes.Buffer
+		err := t.ExecuteTemplate(&buf, name, data)
+		return buf.String(), err
+	}
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// toJson returns v encoded as JSON, without escaping HTML characters
+func toJson(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// sha256sum returns the hex encoded SHA-256 checksum of s
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// indent indents every line of s by spaces spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// required returns v, or an error with msg if v is empty. Used to fail
+// rendering instead of writing incomplete configuration files:
+//
+//	{{ .GetOr "mount/path/to/secret" "" | required "secret is missing" }}
+func required(msg string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, errors.New(msg)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if rv.Len() == 0 {
+			return nil, errors.New(msg)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,236 @@
+package secretsfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+// mapStore returns the secrets of a map, paths containing "forbidden" are
+// denied
+type mapStore map[string]*store.Secret
+
+func (s mapStore) GetSecret(spath string, ctx context.Context) (*store.Secret, error) {
+	if strings.Contains(spath, "forbidden") {
+		return nil, store.NewError(store.ErrPermissionDenied, errors.New("403"))
+	}
+	if sec, ok := s[spath]; ok {
+		return sec, nil
+	}
+	return nil, store.NewError(store.ErrNotFound, errors.New("no such secret"))
+}
+
+func (s mapStore) PutSecret(sec *store.Secret, ctx context.Context) error    { return nil }
+func (s mapStore) DeleteSecret(sec *store.Secret, ctx context.Context) error { return nil }
+func (s mapStore) GetMetadata(sec *store.Secret, ctx context.Context) (store.Metadata, error) {
+	return nil, nil
+}
+func (s mapStore) PutMetadata(sec *store.Secret, name, value string, ctx context.Context) error {
+	return nil
+}
+func (s mapStore) DeleteMetadata(sec *store.Secret, name string, ctx context.Context) error {
+	return nil
+}
+func (s mapStore) GetVersions(spath string, ctx context.Context) ([]int, error) {
+	return nil, nil
+}
+func (s mapStore) GetSecretVersion(spath string, version int, ctx context.Context) (*store.Secret, error) {
+	return s.GetSecret(spath, ctx)
+}
+func (s mapStore) String() string { return "map" }
+
+// newMapStore returns a mapStore containing the secret secret/app/db with the
+// keys password, port and empty, and the empty secret secret/app/tls below
+// the secret secret/app
+func newMapStore() mapStore {
+	keys := []*store.Secret{
+		{Path: "secret/app/db/password", Mode: sfsfh.FILEREAD, Content: []byte("p\"w<1>")},
+		{Path: "secret/app/db/port", Mode: sfsfh.FILEREAD, Content: []byte("5432")},
+		{Path: "secret/app/db/empty", Mode: sfsfh.FILEREAD, Content: []byte{}},
+	}
+	s := mapStore{
+		"secret/app/db":  {Path: "secret/app/db", Mode: sfsfh.DIRREAD, Subs: append(keys, &store.Secret{Path: "secret/app/db/tls", Mode: sfsfh.DIRREAD})},
+		"secret/app/tls": {Path: "secret/app/tls", Mode: sfsfh.DIRREAD},
+		"secret/app": {Path: "secret/app", Mode: sfsfh.DIRREAD, Subs: []*store.Secret{
+			{Path: "secret/app/tls", Mode: sfsfh.DIRREAD},
+			{Path: "secret/app/name", Mode: sfsfh.FILEREAD, Content: []byte("app")},
+			{Path: "secret/app/db", Mode: sfsfh.DIRREAD},
+		}},
+	}
+	for _, k := range keys {
+		s[k.Path] = k
+	}
+	return s
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	store.SetStore(newMapStore())
+
+	var ctx context.Context = &fuse.Context{Caller: fuse.Caller{Pid: uint32(os.Getpid())}}
+	s := secret{ctx: &ctx}
+
+	tables := []struct {
+		text string
+		want string
+		err  bool
+	}{
+		{`{{ .Get "secret/app/db/port" }}`, "5432", false},
+		{`{{ Get "secret/app/db/port" }}`, "5432", false},
+		{`{{ Get "secret/app/db/missing" }}`, "", true},
+		{`{{ GetOr "secret/app/db/port" "1" }}`, "5432", false},
+		{`{{ .GetOr "secret/app/db/missing" "1" }}`, "1", false},
+		{`{{ GetOr "secret/app/db/empty" "1" }}`, "1", false},
+		{`{{ GetOr "secret/forbidden" "1" }}`, "", true},
+		{`{{ range List "secret/app/db" }}{{ . }},{{ end }}`, "empty,password,port,", false},
+		{`{{ List "secret/app/tls" | toJson }}`, "[]", false},
+		{`{{ List "secret/app/db/port" }}`, "", true},
+		{`{{ Get "secret/app/db/password" | b64enc }}`, "cCJ3PDE+", false},
+		{`{{ "cCJ3PDE+" | b64dec }}`, "p\"w<1>", false},
+		{`{{ "!!" | b64dec }}`, "", true},
+		{`{{ Get "secret/app/db/password" | toJson }}`, `"p\"w<1>"`, false},
+		{`{{ Get "secret/app/db/password" | quote }}`, `"p\"w<1>"`, false},
+		{`{{ "secret" | sha256 }}`, "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", false},
+		{`{{ "a\nb" | indent 2 }}`, "  a\n  b", false},
+		{`{{ " a b " | trim | upper }}{{ "C" | lower }}`, "A Bc", false},
+		{`{{ GetOr "secret/app/db/port" "" | required "port is missing" }}`, "5432", false},
+		{`{{ GetOr "secret/app/db/missing" "" | required "port is missing" }}`, "", true},
+		{`{{ .GetAllowEmpty "secret/app/db/empty" }}`, "", false},
+		{`{{ GetAllowEmpty "secret/app/db/port" }}`, "5432", false},
+		{`{{ GetAllowEmpty "secret/app/db/missing" }}`, "", true},
+		{`{{ with .Secret "secret/app/db" }}{{ .port }}:{{ .password }}:{{ .empty }}{{ end }}`, "5432:p\"w<1>:", false},
+		{`{{ range $k, $v := Secret "secret/app/db" }}{{ $k }}={{ $v }};{{ end }}`, "empty=;password=p\"w<1>;port=5432;", false},
+		{`{{ Secret "secret/app/tls" | len }}`, "0", false},
+		{`{{ Secret "secret/app/db/port" }}`, "", true},
+		{`{{ range .Keys "secret/app" }}[{{ base . }}]{{ len ($.Secret .) }};{{ end }}`, "[db]3;[tls]0;", false},
+		{`{{ Keys "secret/app/db" | toJson }}`, `["secret/app/db/tls"]`, false},
+		{`{{ Keys "secret/forbidden" }}`, "", true},
+		{`{{ env "PATH" }}`, os.Getenv("PATH"), false},
+		{`{{ env "SECRETSFS_TEST_UNSET" }}`, "", false},
+	}
+
+	for _, table := range tables {
+		var buf bytes.Buffer
+		tmpl := template.New("test")
+		_, err := tmpl.Funcs(templateFuncs(s, tmpl)).Parse(table.text)
+		if err != nil {
+			t.Fatalf("parsing %s failed: %v", table.text, err)
+		}
+		err = tmpl.Execute(&buf, s)
+		if table.err {
+			if err == nil {
+				t.Errorf("rendering %s was incorrect, got: %q, want an error.", table.text, buf.String())
+			}
+			continue
+		}
+		if err != nil || buf.String() != table.want {
+			t.Errorf("rendering %s was incorrect, got: %q, %v, want: %q.", table.text, buf.String(), err, table.want)
+		}
+	}
+}
+
+func TestTemplateCaller(t *testing.T) {
+	defer SetMountPoint("")
+	SetMountPoint("/mnt/secretsfs")
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("current user unknown:", err)
+	}
+	gid, _ := strconv.Atoi(u.Gid)
+	uid, _ := strconv.Atoi(u.Uid)
+	hostname, _ := os.Hostname()
+	executable, _ := os.Executable()
+
+	var ctx context.Context = &fuse.Context{Caller: fuse.Caller{
+		Owner: fuse.Owner{Uid: uint32(uid), Gid: uint32(gid)},
+		Pid:   uint32(os.Getpid()),
+	}}
+	var noctx context.Context = context.Background()
+
+	tables := []struct {
+		ctx  *context.Context
+		text string
+		want string
+		err  bool
+	}{
+		{&ctx, `{{ .User.Name }}:{{ .User.Uid }}:{{ .User.Gid }}:{{ .User.Home }}`, u.Username + ":" + u.Uid + ":" + u.Gid + ":" + u.HomeDir, false},
+		{&ctx, `{{ printf "users/%s/token" .User.Name }}`, "users/" + u.Username + "/token", false},
+		{&ctx, `{{ gt (len .User.Groups) 0 }}`, "true", false},
+		{&ctx, `{{ .Hostname }}`, hostname, false},
+		{&ctx, `{{ .MountPoint }}`, "/mnt/secretsfs", false},
+		{&ctx, `{{ .Caller.Pid }}:{{ .Caller.Executable }}`, strconv.Itoa(os.Getpid()) + ":" + executable, false},
+		{&noctx, `{{ .User.Name }}`, "", true},
+		{&noctx, `{{ .Caller.Pid }}:{{ .Caller.Executable }}`, "0:", false},
+	}
+
+	for _, table := range tables {
+		var buf bytes.Buffer
+		s := secret{ctx: table.ctx}
+		tmpl := template.New("test")
+		_, err := tmpl.Funcs(templateFuncs(s, tmpl)).Parse(table.text)
+		if err != nil {
+			t.Fatalf("parsing %s failed: %v", table.text, err)
+		}
+		err = tmpl.Execute(&buf, s)
+		if table.err {
+			if err == nil {
+				t.Errorf("rendering %s was incorrect, got: %q, want an error.", table.text, buf.String())
+			}
+			continue
+		}
+		if err != nil || buf.String() != table.want {
+			t.Errorf("rendering %s was incorrect, got: %q, %v, want: %q.", table.text, buf.String(), err, table.want)
+		}
+	}
+}
+
+func TestTemplateDeps(t *testing.T) {
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	store.SetStore(&versionedStore{mapStore: newMapStore(), versions: map[string]string{"secret/app/db": "3"}})
+
+	var ctx context.Context = &fuse.Context{Caller: fuse.Caller{Pid: uint32(os.Getpid())}}
+	tables := []struct {
+		text        string
+		perProcess  bool
+		unversioned bool
+		versions    map[string]secretVersion
+	}{
+		{`{{ .Get "secret/app/db/port" }}`, false, false, map[string]secretVersion{"secret/app/db/port": {sfsfh.FILEREAD, "3"}}},
+		{`{{ .GetOr "secret/app/db/missing" "x" }}`, false, false, map[string]secretVersion{"secret/app/db/missing": {sfsfh.FILEREAD, "3"}}},
+		{`{{ .Secret "secret/app/db" }}`, false, false, map[string]secretVersion{"secret/app/db": {sfsfh.DIRREAD, "3"}}},
+		{`{{ .List "secret/app" }}`, false, true, nil},
+		{`{{ .Keys "secret/app/db" }}`, false, true, map[string]secretVersion{"secret/app/db": {sfsfh.DIRREAD, "3"}}},
+		{`{{ .Hostname }}:{{ .MountPoint }}`, false, false, nil},
+		{`{{ env "PATH" }}`, true, false, nil},
+		{`{{ .Caller.Pid }}`, true, false, nil},
+		{`{{ if false }}{{ env "PATH" }}{{ end }}`, false, false, nil},
+	}
+
+	for _, table := range tables {
+		deps := &renderDeps{}
+		s := secret{ctx: &ctx, deps: deps}
+		tmpl := template.New("test")
+		if _, err := tmpl.Funcs(templateFuncs(s, tmpl)).Parse(table.text); err != nil {
+			t.Fatalf("parsing %s failed: %v", table.text, err)
+		}
+		err := tmpl.Execute(&bytes.Buffer{}, s)
+		if err != nil || deps.perProcess != table.perProcess || deps.unversioned != table.unversioned || !reflect.DeepEqual(deps.versions, table.versions) {
+			t.Errorf("rendering %s was incorrect, got: %+v, %v, want: %t, %t, %v.", table.text, deps, err, table.perProcess, table.unversioned, table.versions)
+		}
+	}
+}
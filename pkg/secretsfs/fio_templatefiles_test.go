@@ -0,0 +1,132 @@
+package secretsfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLinkTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretsfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "templates")
+	for _, d := range []string{"templates/app/conf", "outside"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"templates/app/db.conf":      "conf/db.conf",
+		"templates/app/up.conf":      "../base.conf",
+		"templates/app/abs.conf":     filepath.Join(root, "base.conf"),
+		"templates/app/dangling":     "conf/missing.conf",
+		"templates/app/escape":       "../../outside/secret.conf",
+		"templates/app/abs-escape":   "/etc/passwd",
+		"templates/app/via-link":     "../escape",
+		"templates/app/conf-link":    "conf",
+		"templates/app/back-to-root": "..",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"templates/app/conf/db.conf", "templates/base.conf", "outside/secret.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("app/escape", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		utemplp string
+		target  string
+		outside bool
+	}{
+		{"app/db.conf", "conf/db.conf", false},
+		{"app/up.conf", "../base.conf", false},
+		{"app/abs.conf", "../base.conf", false},
+		{"app/dangling", "conf/missing.conf", false},
+		{"app/conf-link", "conf", false},
+		{"app/back-to-root", "..", false},
+		{"app/escape", "", true},
+		{"app/abs-escape", "", true},
+		{"app/via-link", "", true},
+	}
+
+	for _, table := range tables {
+		target, err := linkTarget(root, table.utemplp)
+		if table.outside {
+			if !errors.Is(err, errLinkOutsideRoot) {
+				t.Errorf("linkTarget of %q was incorrect, got: %q, %v, want: %v.", table.utemplp, target, err, errLinkOutsideRoot)
+			}
+			continue
+		}
+		if err != nil || target != table.target {
+			t.Errorf("linkTarget of %q was incorrect, got: %q, %v, want: %q.", table.utemplp, target, err, table.target)
+		}
+	}
+}
+
+func TestRenderTemplatefilePartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretsfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"shared/layout.tmpl":           `{{ define "db" }}shared {{ . }}{{ end }}{{ define "header" }}# generated{{ end }}`,
+		"root/_partials/db.tmpl":       `{{ define "db" }}host={{ . }}` + "\n" + `port=5432{{ end }}`,
+		"root/_partials/sub/user.tmpl": `user={{ . }}`,
+		"root/app.conf":                `{{ template "header" }}` + "\n" + `{{ template "db" "a" }}` + "\n" + `[b]` + "\n" + `{{ include "db" "b" | indent 2 }}` + "\n" + `{{ template "sub/user.tmpl" "c" }}`,
+		"root/override.conf":           `{{ define "db" }}own {{ . }}{{ end }}{{ template "db" "d" }}`,
+		"root/recursive.conf":          `{{ define "loop" }}{{ include "loop" . }}{{ end }}{{ template "loop" }}`,
+		"root/missing.conf":            `{{ include "nope" . }}`,
+	}
+	for f, text := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer viper.Set("fio.templatefiles.partialspath", "")
+	viper.Set("fio.templatefiles.partialspath", filepath.Join(dir, "shared"))
+
+	tables := []struct {
+		tpath string
+		want  string
+		err   bool
+	}{
+		{"app.conf", "# generated\nhost=a\nport=5432\n[b]\n  host=b\n  port=5432\nuser=c", false},
+		{"override.conf", "own d", false},
+		{"recursive.conf", "", true},
+		{"missing.conf", "", true},
+	}
+
+	ctx := context.Background()
+	root := filepath.Join(dir, "root")
+	for _, table := range tables {
+		content, err := renderTemplatefile(root, filepath.Join(root, table.tpath), &ctx)
+		if table.err {
+			if err == nil {
+				t.Errorf("rendering %s was incorrect, got: %q, want an error.", table.tpath, content)
+			}
+			continue
+		}
+		if err != nil || string(content) != table.want {
+			t.Errorf("rendering %s was incorrect, got: %q, %v, want: %q.", table.tpath, content, err, table.want)
+		}
+	}
+}
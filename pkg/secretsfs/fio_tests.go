@@ -103,7 +103,11 @@ func (t *testNode) getMode() uint32 {
 	return fuse.S_IFDIR
 }
 
-type FIOTest struct{}
+type FIOTest struct {
+	FIOReadOnly
+	FIONoSymlinks
+	FIONoXattr
+}
 
 var _ = (FIORoot)((*FIOTest)(nil))
 
@@ -160,24 +164,7 @@ func (sf *FIOTest) Lookup(n *SfsNode, ctx context.Context, name string, out *fus
 		"inode":      GetInode(tn.path),
 		"mode":       tn.getMode()}).Debug("log values")
 
-	// if true, then get an inode for it
-	stable := fs.StableAttr{
-		Mode: tn.getMode(),
-		Ino:  GetInode(tn.path),
-	}
-	log.WithFields(log.Fields{
-		"n":          n,
-		"n.npath":    n.npath,
-		"name":       name,
-		"out.NodeId": out.NodeId,
-		"tn":         tn,
-		"inode":      GetInode(tn.path),
-		"mode":       tn.getMode(),
-		"stable":     stable}).Debug("log values")
-	operations := NewNode(filepath.Join(n.npath, name))
-	child := n.NewInode(ctx, operations, stable)
-	out.NodeId = GetInode(tn.path)
-	return child, fs.OK
+	return newChildInode(n, ctx, tn.path, tn.getMode(), out), fs.OK
 }
 
 //Opener
@@ -189,7 +176,7 @@ func (sf *FIOTest) Open(n *SfsNode, ctx context.Context, flags uint32) (fh fs.Fi
 func (sf *FIOTest) Read(n *SfsNode, ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 	tn := testnodes.getTestNodeByPath(n.npath)
-	results := fuse.ReadResultData(tn.content)
+	results := fuse.ReadResultData(readAt(tn.content, dest, off))
 	log.WithFields(log.Fields{
 		"n":       n,
 		"n.npath": n.npath,
@@ -0,0 +1,406 @@
+package secretsfs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+// FIOVersions shows all retained versions of the secrets in the store:
+//
+//	versions/
+//	└── secret
+//	    └── app
+//	        └── db
+//	            ├── 1
+//	            │   └── password
+//	            ├── 2
+//	            │   └── password
+//	            └── current -> 2
+//
+// Versions named like secrets below the secret are listed with versionMarker,
+// e.g. @2, so that both stay reachable.
+type FIOVersions struct {
+	FIOReadOnly
+	FIONoXattr
+}
+
+var _ = (FIORoot)((*FIOVersions)(nil))
+
+// versionMarker marks the version directories in node paths, e.g.
+// /versions/secret/app/db/@2/password, as secrets may be named like versions
+const versionMarker = "@"
+
+// currentVersion is the name of the symlink to the latest version
+const currentVersion = "current"
+
+// versionPath is a node path of FIOVersions split into its parts
+type versionPath struct {
+	secpath string // path of the secret
+	version string // version number or currentVersion, "" if not inside a version
+	key     string // key inside the version, "" if not a key
+}
+
+// parseVersionPath splits the subpath of a node of FIOVersions into its parts
+func parseVersionPath(subpath string) versionPath {
+	parts := strings.Split(strings.Trim(subpath, "/"), "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, versionMarker) || !isVersionName(part[len(versionMarker):]) {
+			continue
+		}
+		return versionPath{
+			secpath: strings.Join(parts[:i], "/"),
+			version: part[len(versionMarker):],
+			key:     strings.Join(parts[i+1:], "/"),
+		}
+	}
+	return versionPath{secpath: strings.Join(parts, "/")}
+}
+
+// isVersionName returns whether name is a version number or currentVersion
+func isVersionName(name string) bool {
+	if name == currentVersion {
+		return true
+	}
+	v, err := strconv.Atoi(name)
+	return err == nil && v > 0
+}
+
+func (fv *FIOVersions) Readdir(n *SfsNode, ctx context.Context) (out fs.DirStream, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+
+	_, subpath := rootName(n.npath)
+	vp := parseVersionPath(subpath)
+	var direntries []fuse.DirEntry
+	switch {
+	case vp.version == "":
+		sto := *store.GetStore()
+		sec, err := sto.GetSecret(vp.secpath, ctx)
+		if err != nil {
+			log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": vp.secpath, "error": err}).Error("got error while getting secret")
+			return nil, errnoFromError(err)
+		}
+		if !sfsfh.IsDir(sec.Mode) {
+			return nil, syscall.ENOTDIR
+		}
+		// keys are only shown inside of versions
+		subs := make(map[string]bool)
+		for _, v := range sec.Subs {
+			if !sfsfh.IsDir(v.Mode) {
+				continue
+			}
+			subs[filepath.Base(v.Path)] = true
+			fixedpath := fv.prefixPath(v.Path)
+			direntries = append(direntries, fuse.DirEntry{
+				Name: filepath.Base(fixedpath),
+				Ino:  GetInode(fixedpath),
+				Mode: uint32(v.Mode),
+			})
+		}
+		versions, errno := fv.versions(ctx, vp.secpath)
+		if errno != fs.OK {
+			return nil, errno
+		}
+		for _, v := range versions {
+			version := strconv.Itoa(v)
+			direntries = append(direntries, fuse.DirEntry{
+				Name: versionName(version, subs),
+				Ino:  GetInode(fv.versionNodePath(vp.secpath, version)),
+				Mode: uint32(sfsfh.DIRREAD),
+			})
+		}
+		if len(versions) > 0 {
+			direntries = append(direntries, fuse.DirEntry{
+				Name: versionName(currentVersion, subs),
+				Ino:  GetInode(fv.versionNodePath(vp.secpath, currentVersion)),
+				Mode: fuse.S_IFLNK,
+			})
+		}
+	case vp.key == "":
+		sec, errno := fv.secretVersion(ctx, vp)
+		if errno != fs.OK {
+			return nil, errno
+		}
+		for _, v := range sec.Subs {
+			direntries = append(direntries, fuse.DirEntry{
+				Name: filepath.Base(v.Path),
+				Ino:  GetInode(filepath.Join(fv.versionNodePath(vp.secpath, vp.version), filepath.Base(v.Path))),
+				Mode: uint32(v.Mode),
+			})
+		}
+	default:
+		return nil, syscall.ENOTDIR
+	}
+	log.WithFields(log.Fields{"direntries": direntries}).Debug("log values")
+	return fs.NewListDirStream(direntries), fs.OK
+}
+
+func (fv *FIOVersions) Lookup(n *SfsNode, ctx context.Context, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+
+	_, subpath := rootName(n.npath)
+	vp := parseVersionPath(subpath)
+	switch {
+	case vp.version == "":
+		version, errno := fv.lookupVersion(ctx, vp.secpath, name)
+		if errno != fs.OK {
+			return nil, errno
+		}
+		if version != "" {
+			versions, errno := fv.versions(ctx, vp.secpath)
+			if errno != fs.OK {
+				return nil, errno
+			}
+			if version == currentVersion && len(versions) > 0 {
+				return newChildInode(n, ctx, fv.versionNodePath(vp.secpath, version), fuse.S_IFLNK, out), fs.OK
+			}
+			for _, v := range versions {
+				if strconv.Itoa(v) == version {
+					return newChildInode(n, ctx, fv.versionNodePath(vp.secpath, version), uint32(sfsfh.DIRREAD), out), fs.OK
+				}
+			}
+			if name != version {
+				return nil, syscall.ENOENT
+			}
+		}
+		sto := *store.GetStore()
+		fullname := filepath.Join(vp.secpath, name)
+		sec, err := sto.GetSecret(fullname, ctx)
+		if errors.Is(err, store.ErrPermissionDenied) {
+			// secrets below may still be readable, see FIOSecretsFiles.Lookup
+			sec = &store.Secret{Path: fullname, Mode: sfsfh.DIRNOREAD}
+		} else if err != nil {
+			log.WithFields(log.Fields{"calling": "sto.GetSecret(fullname, ctx)", "fullname": fullname, "error": err}).Warn("got error while getting secret")
+			return nil, errnoFromError(err)
+		}
+		if !sfsfh.IsDir(sec.Mode) {
+			return nil, syscall.ENOENT
+		}
+		return newChildInode(n, ctx, fv.prefixPath(fullname), uint32(sec.Mode), out), fs.OK
+	case vp.key == "":
+		sec, errno := fv.secretVersion(ctx, vp)
+		if errno != fs.OK {
+			return nil, errno
+		}
+		for _, v := range sec.Subs {
+			if filepath.Base(v.Path) == name {
+				npath := filepath.Join(fv.versionNodePath(vp.secpath, vp.version), name)
+				return newChildInode(n, ctx, npath, uint32(v.Mode), out), fs.OK
+			}
+		}
+		return nil, syscall.ENOENT
+	default:
+		return nil, syscall.ENOTDIR
+	}
+}
+
+func (fv *FIOVersions) Open(n *SfsNode, ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "flags": strconv.FormatInt(int64(flags), 16)}).Debug("log values")
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	content, errno := fv.content(n, ctx)
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	return newContentHandle(content), 0, fs.OK
+}
+
+func (fv *FIOVersions) Read(n *SfsNode, ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	if h, ok := f.(*contentHandle); ok {
+		return h.read(dest, off), fs.OK
+	}
+	content, errno := fv.content(n, ctx)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	return fuse.ReadResultData(readAt(content, dest, off)), fs.OK
+}
+
+func (fv *FIOVersions) Getattr(n *SfsNode, ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+
+	out.Ino = GetInode(n.npath)
+	if IsRootPath(n.npath) || fh != nil {
+		return fs.OK
+	}
+	_, subpath := rootName(n.npath)
+	vp := parseVersionPath(subpath)
+	switch {
+	case vp.version == "":
+		sto := *store.GetStore()
+		_, err := sto.GetSecret(vp.secpath, ctx)
+		if errors.Is(err, store.ErrPermissionDenied) {
+			out.Mode &^= 0666
+		} else if err != nil {
+			log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": vp.secpath, "error": err}).Warn("got error while getting secret")
+			return errnoFromError(err)
+		}
+	case vp.version == currentVersion:
+		target, errno := fv.Readlink(n, ctx)
+		if errno != fs.OK {
+			return errno
+		}
+		out.Size = uint64(len(target))
+	case vp.key == "":
+		_, errno := fv.secretVersion(ctx, vp)
+		return errno
+	default:
+		content, errno := fv.content(n, ctx)
+		if errno != fs.OK {
+			return errno
+		}
+		out.Size = uint64(len(content))
+	}
+	return fs.OK
+}
+
+// Readlink returns the latest version as target of the symlink current
+func (fv *FIOVersions) Readlink(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	_, subpath := rootName(n.npath)
+	vp := parseVersionPath(subpath)
+	if vp.version != currentVersion || vp.key != "" {
+		return nil, syscall.EINVAL
+	}
+	versions, errno := fv.versions(ctx, vp.secpath)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	if len(versions) == 0 {
+		return nil, syscall.ENOENT
+	}
+	subs, errno := fv.subSecrets(ctx, vp.secpath)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	return []byte(versionName(strconv.Itoa(versions[len(versions)-1]), subs)), fs.OK
+}
+
+func (fv *FIOVersions) FIOPath() string {
+	return "versions"
+}
+
+func (fv *FIOVersions) prefixPath(npath string) string {
+	return string(filepath.Separator) + filepath.Join(fv.FIOPath(), npath)
+}
+
+// versionNodePath returns the node path of version of the secret secpath
+func (fv *FIOVersions) versionNodePath(secpath, version string) string {
+	return fv.prefixPath(filepath.Join(secpath, versionMarker+version))
+}
+
+// versionName returns the name version is listed with inside of a secret
+// containing the secrets subs
+func versionName(version string, subs map[string]bool) string {
+	if subs[version] {
+		return versionMarker + version
+	}
+	return version
+}
+
+// lookupVersion returns the version name refers to inside of the secret
+// secpath, "" if it refers to a secret. Names of versions only refer to the
+// version, if there is no secret named like it, see versionName.
+func (fv *FIOVersions) lookupVersion(ctx context.Context, secpath, name string) (string, syscall.Errno) {
+	if strings.HasPrefix(name, versionMarker) && isVersionName(name[len(versionMarker):]) {
+		return name[len(versionMarker):], fs.OK
+	}
+	if !isVersionName(name) {
+		return "", fs.OK
+	}
+	subs, errno := fv.subSecrets(ctx, secpath)
+	if errno != fs.OK || subs[name] {
+		return "", errno
+	}
+	return name, fs.OK
+}
+
+// subSecrets returns the names of the secrets below the secret secpath.
+// Secrets the user may not list have none.
+func (fv *FIOVersions) subSecrets(ctx context.Context, secpath string) (map[string]bool, syscall.Errno) {
+	sto := *store.GetStore()
+	sec, err := sto.GetSecret(secpath, ctx)
+	if errors.Is(err, store.ErrPermissionDenied) || errors.Is(err, store.ErrNotFound) {
+		return nil, fs.OK
+	} else if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecret(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting secret")
+		return nil, errnoFromError(err)
+	}
+	subs := make(map[string]bool)
+	for _, v := range sec.Subs {
+		if sfsfh.IsDir(v.Mode) {
+			subs[filepath.Base(v.Path)] = true
+		}
+	}
+	return subs, fs.OK
+}
+
+// versions returns the versions of the secret secpath. Paths which aren't
+// secrets and secrets the user may not read the metadata of have none.
+func (fv *FIOVersions) versions(ctx context.Context, secpath string) ([]int, syscall.Errno) {
+	sto := *store.GetStore()
+	versions, err := sto.GetVersions(secpath, ctx)
+	if errors.Is(err, store.ErrPermissionDenied) || errors.Is(err, store.ErrNotFound) {
+		log.WithFields(log.Fields{"calling": "sto.GetVersions(secpath, ctx)", "secpath": secpath, "error": err}).Debug("secret has no readable versions")
+		return nil, fs.OK
+	} else if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetVersions(secpath, ctx)", "secpath": secpath, "error": err}).Error("got error while getting versions")
+		return nil, errnoFromError(err)
+	}
+	return versions, fs.OK
+}
+
+// secretVersion returns the version of the secret vp points into
+func (fv *FIOVersions) secretVersion(ctx context.Context, vp versionPath) (*store.Secret, syscall.Errno) {
+	version, err := strconv.Atoi(vp.version)
+	if err != nil {
+		// the kernel resolves current itself, it is never looked up through
+		return nil, syscall.ENOENT
+	}
+	sto := *store.GetStore()
+	sec, err := sto.GetSecretVersion(vp.secpath, version, ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"calling": "sto.GetSecretVersion(secpath, version, ctx)", "secpath": vp.secpath, "version": version, "error": err}).Error("got error while getting secret version")
+		return nil, errnoFromError(err)
+	}
+	return sec, fs.OK
+}
+
+// content returns the value of the key n inside of a version
+func (fv *FIOVersions) content(n *SfsNode, ctx context.Context) ([]byte, syscall.Errno) {
+	_, subpath := rootName(n.npath)
+	vp := parseVersionPath(subpath)
+	if vp.key == "" {
+		return nil, syscall.EISDIR
+	}
+	sec, errno := fv.secretVersion(ctx, vp)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	for _, v := range sec.Subs {
+		if filepath.Base(v.Path) == vp.key {
+			return v.Content, fs.OK
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+func init() {
+	fioroot := FIOVersions{}
+	fm := FIOMap{
+		Root: &fioroot,
+	}
+	RegisterRoot(&fm)
+}
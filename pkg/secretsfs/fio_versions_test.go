@@ -0,0 +1,95 @@
+package secretsfs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
+
+func TestParseVersionPath(t *testing.T) {
+	tables := []struct {
+		subpath string
+		want    versionPath
+	}{
+		{"", versionPath{}},
+		{"secret/app/db", versionPath{secpath: "secret/app/db"}},
+		{"secret/app/db/@2", versionPath{secpath: "secret/app/db", version: "2"}},
+		{"secret/app/db/@2/password", versionPath{secpath: "secret/app/db", version: "2", key: "password"}},
+		{"secret/app/db/@current", versionPath{secpath: "secret/app/db", version: "current"}},
+		{"secret/app/2/@1/password", versionPath{secpath: "secret/app/2", version: "1", key: "password"}},
+		{"secret/@team/db", versionPath{secpath: "secret/@team/db"}},
+		{"secret/app/@0", versionPath{secpath: "secret/app/@0"}},
+	}
+
+	for _, table := range tables {
+		got := parseVersionPath(table.subpath)
+		if got != table.want {
+			t.Errorf("parsing '%v' was incorrect, got: '%+v', want: '%+v'\n", table.subpath, got, table.want)
+		}
+	}
+}
+
+// versionStore is a mapStore, in which the secret secret/app has the versions
+// 1 and 2
+type versionStore struct {
+	mapStore
+}
+
+func (s versionStore) GetVersions(spath string, ctx context.Context) ([]int, error) {
+	if spath == "secret/app" {
+		return []int{1, 2}, nil
+	}
+	return nil, nil
+}
+
+func TestVersionsNamedLikeSecrets(t *testing.T) {
+	old := *store.GetStore()
+	defer store.SetStore(old)
+	sto := versionStore{newMapStore()}
+	sto.mapStore["secret/app/2"] = &store.Secret{Path: "secret/app/2", Mode: sfsfh.DIRREAD}
+	app := sto.mapStore["secret/app"]
+	app.Subs = append(app.Subs, &store.Secret{Path: "secret/app/2", Mode: sfsfh.DIRREAD})
+	store.SetStore(sto)
+
+	fv := &FIOVersions{}
+	ctx := context.Background()
+	ds, errno := fv.Readdir(NewNode("/versions/secret/app"), ctx)
+	if errno != 0 {
+		t.Fatalf("listing secret/app failed: %v", errno)
+	}
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"1", "2", "@2", "current", "db", "tls"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listing secret/app was incorrect, got: %v, want: %v.", names, want)
+	}
+	if target, errno := fv.Readlink(NewNode("/versions/secret/app/@current"), ctx); errno != 0 || string(target) != "@2" {
+		t.Errorf("target of current was incorrect, got: %q, %v, want: %q.", target, errno, "@2")
+	}
+
+	tables := []struct {
+		name    string
+		version string
+	}{
+		{"1", "1"},
+		{"2", ""},
+		{"@2", "2"},
+		{"@1", "1"},
+		{"current", "current"},
+		{"db", ""},
+	}
+
+	for _, table := range tables {
+		version, errno := fv.lookupVersion(ctx, "secret/app", table.name)
+		if errno != 0 || version != table.version {
+			t.Errorf("looking up %s was incorrect, got: %q, %v, want: %q.", table.name, version, errno, table.version)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package secretsfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// contentHandle is the filehandle of a file opened for reading. It contains a
+// snapshot of the content taken at Open, so that reading the file in chunks
+// returns consistent data, even if the secret changes in between.
+type contentHandle struct {
+	mu      sync.Mutex
+	content []byte
+}
+
+// newContentHandle returns a contentHandle containing content
+func newContentHandle(content []byte) *contentHandle {
+	return &contentHandle{content: content}
+}
+
+// read returns the part of the snapshot requested by a read of len(dest)
+// bytes at offset off
+func (h *contentHandle) read(dest []byte, off int64) fuse.ReadResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return fuse.ReadResultData(readAt(h.content, dest, off))
+}
+
+// Getattr reports the size of the snapshot, so that it matches the content
+// actually read
+var _ = (fs.FileGetattrer)((*contentHandle)(nil))
+
+func (h *contentHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out.Size = uint64(len(h.content))
+	return fs.OK
+}
+
+// Release drops the snapshot when the file is closed
+var _ = (fs.FileReleaser)((*contentHandle)(nil))
+
+func (h *contentHandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.content = nil
+	return fs.OK
+}
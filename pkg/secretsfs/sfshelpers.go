@@ -2,38 +2,16 @@ package secretsfs
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
-)
-
-// pathsInodes contains all registered inodes so far, mapped to their paths
-var pathsInodes map[string]uint64 = make(map[string]uint64)
 
-// GetInode returns a valid inode for npath. If it isn't registered yet, it will
-// be registered
-func GetInode(npath string) uint64 {
-	// clip trailing '/'
-	npath = trimPath(npath)
-	// get inode if existent
-	inode, ok := pathsInodes[npath]
-	// if not existent, assign new inode
-	if !ok {
-		inode = uint64(len(pathsInodes) + 2)
-		pathsInodes[npath] = inode
-	}
-	return inode
-}
-
-// GetInodeIfRegistered returns the inode if it is registered, won't register it
-// if it isn't already registered
-func GetInodeIfRegistered(npath string) (uint64, bool) {
-	npath = trimPath(npath)
-	inode, ok := pathsInodes[npath]
-	return inode, ok
-}
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
+)
 
 // trimPath removes '/' if it is the last character and returns resulting string
 func trimPath(npath string) string {
@@ -69,11 +47,79 @@ func GetMapStringKeys(m map[string]interface{}) []string {
 	return keys
 }
 
+// storeErrnos maps the typed errors of stores to the errnos returned to the
+// caller of a filesystem operation
+var storeErrnos = []struct {
+	err   error
+	errno syscall.Errno
+}{
+	{store.ErrNotFound, syscall.ENOENT},
+	{store.ErrPermissionDenied, syscall.EACCES},
+	{store.ErrAuthFailed, syscall.EKEYEXPIRED},
+	{store.ErrNoCredentials, syscall.EPERM},
+	{store.ErrUnavailable, syscall.EIO},
+	{store.ErrTimeout, syscall.EAGAIN},
+	{store.ErrExists, syscall.EEXIST},
+	{store.ErrNotEmpty, syscall.ENOTEMPTY},
+	{store.ErrNotSupported, syscall.ENOTSUP},
+}
+
+// errnoFromError returns the errno corresponding to an error returned by a
+// store, so that callers can distinguish e.g. a missing secret from an
+// unreachable store. Unknown errors are returned as EIO.
+func errnoFromError(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	for _, se := range storeErrnos {
+		if errors.Is(err, se.err) {
+			return se.errno
+		}
+	}
+	return syscall.EIO
+}
+
+// readAt returns the part of content requested by a read of len(dest) bytes
+// at offset off
+func readAt(content []byte, dest []byte, off int64) []byte {
+	if off < 0 || off >= int64(len(content)) {
+		return nil
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(content)) {
+		end = int64(len(content))
+	}
+	return content[off:end]
+}
+
+// resize truncates b to size, or extends it with zero bytes
+func resize(b []byte, size int64) []byte {
+	if size <= int64(len(b)) {
+		return b[:size]
+	}
+	return append(b, make([]byte, size-int64(len(b)))...)
+}
+
+// xattrValue copies value into dest as returned by getxattr(2) and
+// listxattr(2). An empty dest asks for the size of value only.
+func xattrValue(value []byte, dest []byte) (uint32, syscall.Errno) {
+	if len(dest) == 0 {
+		return uint32(len(value)), 0
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
 // getModeFromFileInfo returns the corresponding fuse.Attr.Mode of a os.FileInfo
 func getModeFromFileInfo(fi os.FileInfo) uint32 {
 	if fi.IsDir() {
 		return fuse.S_IFDIR
 	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return fuse.S_IFLNK
+	}
 	return fuse.S_IFREG
 }
 
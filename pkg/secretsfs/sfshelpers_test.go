@@ -1,7 +1,17 @@
 package secretsfs
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/muryoutaisuu/secretsfs/pkg/store"
 )
 
 func TestRootName(t *testing.T) {
@@ -27,3 +37,185 @@ func TestRootName(t *testing.T) {
 		}
 	}
 }
+
+func TestErrnoFromError(t *testing.T) {
+	tables := []struct {
+		err   error
+		errno syscall.Errno
+	}{
+		{nil, 0},
+		{store.ErrNotFound, syscall.ENOENT},
+		{store.NewError(store.ErrNotFound, errors.New("no such secret")), syscall.ENOENT},
+		{store.NewError(store.ErrPermissionDenied, errors.New("403")), syscall.EACCES},
+		{store.NewError(store.ErrAuthFailed, errors.New("invalid secret id")), syscall.EKEYEXPIRED},
+		{store.NewError(store.ErrNoCredentials, errors.New("no roleid file")), syscall.EPERM},
+		{store.NewError(store.ErrUnavailable, errors.New("connection refused")), syscall.EIO},
+		{fmt.Errorf("rendering failed: %w", store.NewError(store.ErrTimeout, errors.New("timeout"))), syscall.EAGAIN},
+		{store.NewError(store.ErrNotEmpty, errors.New("contains keys")), syscall.ENOTEMPTY},
+		{errors.New("unknown"), syscall.EIO},
+	}
+
+	for _, table := range tables {
+		errno := errnoFromError(table.err)
+		if errno != table.errno {
+			t.Errorf("errno of '%v' was incorrect, got: '%v', want: '%v'\n", table.err, errno, table.errno)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	tables := []struct {
+		b    string
+		size int64
+		want string
+	}{
+		{"password", 4, "pass"},
+		{"password", 8, "password"},
+		{"pass", 6, "pass\x00\x00"},
+		{"", 0, ""},
+	}
+
+	for _, table := range tables {
+		got := string(resize([]byte(table.b), table.size))
+		if got != table.want {
+			t.Errorf("resizing '%v' to %v was incorrect, got: '%q', want: '%q'\n", table.b, table.size, got, table.want)
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	content := []byte("0123456789")
+	tables := []struct {
+		size int
+		off  int64
+		want string
+	}{
+		{4096, 0, "0123456789"},
+		{4, 0, "0123"},
+		{4, 4, "4567"},
+		{4, 8, "89"},
+		{4, 10, ""},
+		{4, 20, ""},
+	}
+
+	for _, table := range tables {
+		got := string(readAt(content, make([]byte, table.size), table.off))
+		if got != table.want {
+			t.Errorf("reading %v bytes at %v was incorrect, got: '%v', want: '%v'\n", table.size, table.off, got, table.want)
+		}
+	}
+}
+
+func TestXattrValue(t *testing.T) {
+	tables := []struct {
+		value string
+		size  int
+		n     uint32
+		errno syscall.Errno
+		want  string
+	}{
+		{"42", 0, 2, 0, ""},
+		{"42", 1, 2, syscall.ERANGE, ""},
+		{"42", 2, 2, 0, "42"},
+		{"42", 4096, 2, 0, "42"},
+		{"", 4096, 0, 0, ""},
+	}
+
+	for _, table := range tables {
+		dest := make([]byte, table.size)
+		n, errno := xattrValue([]byte(table.value), dest)
+		if n != table.n || errno != table.errno {
+			t.Errorf("getting '%v' into %v bytes was incorrect, got: %v, '%v', want: %v, '%v'\n", table.value, table.size, n, errno, table.n, table.errno)
+		}
+		if table.size > 0 && errno == 0 && string(dest[:n]) != table.want {
+			t.Errorf("value of '%v' was incorrect, got: '%v', want: '%v'\n", table.value, string(dest[:n]), table.want)
+		}
+	}
+}
+
+func TestInodeTable(t *testing.T) {
+	it := newInodeTable()
+	a := it.get("/tests/a")
+	b := it.get("/tests/b")
+	if a == b {
+		t.Errorf("inodes of different paths are equal: '%v'\n", a)
+	}
+	if got := it.get("/tests/a"); got != a {
+		t.Errorf("inode of '/tests/a' changed, got: '%v', want: '%v'\n", got, a)
+	}
+	if npath, ok := it.path(b); !ok || npath != "/tests/b" {
+		t.Errorf("path of inode '%v' was incorrect, got: '%v', want: '/tests/b'\n", b, npath)
+	}
+
+	// removed paths get a new inode, inodes are never reused
+	it.remove("/tests/a")
+	if _, ok := it.lookup("/tests/a"); ok {
+		t.Errorf("removed path '/tests/a' is still registered\n")
+	}
+	if got := it.get("/tests/a"); got == a || got == b {
+		t.Errorf("inode '%v' was reused for '/tests/a'\n", got)
+	}
+
+	// pinned paths survive gc, listed ones are collected after listedTimeout
+	it.pin("/tests")
+	it.gc(time.Now())
+	if n := it.len(); n != 3 {
+		t.Errorf("number of inodes after gc was incorrect, got: '%v', want: '3'\n", n)
+	}
+	it.gc(time.Now().Add(listedTimeout))
+	if _, ok := it.lookup("/tests"); !ok {
+		t.Errorf("pinned path '/tests' was garbage collected\n")
+	}
+	if n := it.len(); n != 1 {
+		t.Errorf("number of inodes after gc was incorrect, got: '%v', want: '1'\n", n)
+	}
+}
+
+func TestInodeTableForget(t *testing.T) {
+	ctx := context.Background()
+	root := &fs.Inode{}
+	fs.NewNodeFS(root, &fs.Options{})
+	it := newInodeTable()
+	// newInode returns the inode of npath as created by a Lookup, the kernel
+	// references it, if it is added to the root
+	newInode := func(npath string, referenced bool) *fs.Inode {
+		inode := root.NewInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFREG, Ino: it.getFor(npath, fuse.S_IFREG)})
+		if referenced {
+			root.AddChild(npath, inode, true)
+		}
+		it.attach(npath, inode)
+		return inode
+	}
+
+	listed := it.get("/s/listed")
+	referenced := newInode("/s/referenced", true)
+	forgotten := newInode("/s/forgotten", false)
+	pinned := newInode("/s/pinned", false)
+	it.pin("/s/pinned")
+	it.gc(time.Now())
+
+	tables := []struct {
+		name  string
+		npath string
+		ino   uint64
+		kept  bool
+	}{
+		{"listed", "/s/listed", listed, true},
+		{"referenced", "/s/referenced", referenced.StableAttr().Ino, true},
+		{"forgotten", "/s/forgotten", forgotten.StableAttr().Ino, false},
+		{"pinned", "/s/pinned", pinned.StableAttr().Ino, true},
+	}
+
+	for _, table := range tables {
+		it.forget(table.ino)
+		ino, ok := it.lookup(table.npath)
+		if ok != table.kept || ok && ino != table.ino {
+			t.Errorf("inode of %s after forget was incorrect, got: %v, %t, want: %v, %t.", table.name, ino, ok, table.ino, table.kept)
+		}
+	}
+
+	// a Lookup after a gc returns the inode number listed by Readdir
+	if got := newInode("/s/listed", true).StableAttr().Ino; got != listed {
+		t.Errorf("inode of listed path after gc was incorrect, got: %v, want: %v.", got, listed)
+	}
+}
@@ -0,0 +1,268 @@
+package secretsfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// inodes contains the inodes of all nodes known to secretsfs
+var inodes = newInodeTable()
+
+// listedTimeout is how long inode numbers only listed by Readdir are kept, so
+// that a following Lookup of the entry returns the same number
+const listedTimeout = time.Minute
+
+// inodeEntry is the inode assigned to a node path
+type inodeEntry struct {
+	ino    uint64
+	inode  *fs.Inode // inode created for the path, nil if only listed by Readdir
+	listed time.Time // last time the number was returned without an inode
+	pinned bool      // never garbage collected, e.g. the root paths of FIOs
+}
+
+// inodeTable assigns inode numbers to node paths. It is used concurrently by
+// all goroutines serving FUSE requests.
+// Inode numbers are never reused, so that a number still known to the kernel
+// can't point to a different path. Entries are removed once the kernel forgot
+// their inode, see forgetNotifier. Entries only listed by Readdir are garbage
+// collected after listedTimeout, once the table grows beyond
+// general.inodes.max entries.
+type inodeTable struct {
+	mu      sync.Mutex
+	next    uint64 // next inode number to assign
+	entries map[string]*inodeEntry
+	paths   map[uint64]string // reverse lookup of entries
+	gcAt    int               // minimal size of the table for the next gc
+}
+
+func newInodeTable() *inodeTable {
+	return &inodeTable{
+		next:    2, // 1 is the inode of the mountpoint
+		entries: make(map[string]*inodeEntry),
+		paths:   make(map[uint64]string),
+	}
+}
+
+// get returns the inode number of npath, a new one is assigned if npath isn't
+// registered yet
+func (t *inodeTable) get(npath string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[npath]
+	if !ok {
+		if max := viper.GetInt("general.inodes.max"); max > 0 && len(t.entries) >= max && len(t.entries) >= t.gcAt {
+			t.gc(time.Now())
+		}
+		e = t.add(npath, t.nextIno())
+	}
+	if e.inode == nil {
+		e.listed = time.Now()
+	}
+	return e.ino
+}
+
+// getFor returns the inode number of npath for a node of type mode. If the
+// type of the node changed, e.g. a key was turned into an alias, a new inode
+// number is assigned, as the kernel may still reference the old inode.
+func (t *inodeTable) getFor(npath string, mode uint32) uint64 {
+	t.mu.Lock()
+	if e, ok := t.entries[npath]; ok && !e.pinned && e.inode != nil && e.inode.StableAttr().Mode&syscall.S_IFMT != mode&syscall.S_IFMT {
+		delete(t.paths, e.ino)
+		delete(t.entries, npath)
+	}
+	t.mu.Unlock()
+	return t.get(npath)
+}
+
+// lookup returns the inode number of npath, if it is registered
+func (t *inodeTable) lookup(npath string) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[npath]
+	if !ok {
+		return 0, false
+	}
+	return e.ino, true
+}
+
+// path returns the node path of inode number ino, if it is registered
+func (t *inodeTable) path(ino uint64) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	npath, ok := t.paths[ino]
+	return npath, ok
+}
+
+// attach remembers the inode created for npath, so that the entry is kept as
+// long as the kernel references the inode. The entry is registered again, if
+// it was garbage collected in the meantime.
+func (t *inodeTable) attach(npath string, inode *fs.Inode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ino := inode.StableAttr().Ino
+	e, ok := t.entries[npath]
+	if !ok || e.ino != ino {
+		if ok {
+			delete(t.paths, e.ino)
+		}
+		e = t.add(npath, ino)
+	}
+	e.inode = inode
+}
+
+// forget removes the entry of inode number ino, if the kernel forgot its inode
+func (t *inodeTable) forget(ino uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	npath, ok := t.paths[ino]
+	if !ok {
+		return
+	}
+	e := t.entries[npath]
+	if e.pinned || e.inode == nil || !e.inode.Forgotten() {
+		return
+	}
+	delete(t.paths, ino)
+	delete(t.entries, npath)
+}
+
+// pin registers npath and excludes it from garbage collection
+func (t *inodeTable) pin(npath string) uint64 {
+	ino := t.get(npath)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[npath].pinned = true
+	return ino
+}
+
+// remove drops the entry of npath, e.g. after the secret was deleted. A node
+// created at the same path later on gets a new inode number.
+func (t *inodeTable) remove(npath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[npath]; ok && !e.pinned {
+		delete(t.paths, e.ino)
+		delete(t.entries, npath)
+	}
+}
+
+// len returns the number of registered entries
+func (t *inodeTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+// snapshot returns all registered inode numbers mapped to their paths
+func (t *inodeTable) snapshot() map[string]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string]uint64, len(t.entries))
+	for npath, e := range t.entries {
+		m[npath] = e.ino
+	}
+	return m
+}
+
+// add registers npath with inode number ino. Must have t.mu.
+func (t *inodeTable) add(npath string, ino uint64) *inodeEntry {
+	e := &inodeEntry{ino: ino}
+	t.entries[npath] = e
+	t.paths[ino] = npath
+	return e
+}
+
+// nextIno returns a new inode number. Must have t.mu.
+func (t *inodeTable) nextIno() uint64 {
+	ino := t.next
+	t.next++
+	return ino
+}
+
+// gc removes all entries only listed by Readdir, that weren't listed since
+// listedTimeout before now. Entries of inodes are removed by forget. If most
+// entries are kept, the next gc is postponed until the table doubled its size,
+// so that gc doesn't run on every new entry. Must have t.mu.
+func (t *inodeTable) gc(now time.Time) {
+	before := len(t.entries)
+	for npath, e := range t.entries {
+		if e.pinned || e.inode != nil || now.Sub(e.listed) < listedTimeout {
+			continue
+		}
+		delete(t.paths, e.ino)
+		delete(t.entries, npath)
+	}
+	t.gcAt = 2 * len(t.entries)
+	log.WithFields(log.Fields{
+		"before": before,
+		"after":  len(t.entries),
+		"nextgc": t.gcAt}).Debug("garbage collected inodes")
+}
+
+// forgetNotifier is the raw filesystem of go-fuse, which notifies the inode
+// table about inodes forgotten by the kernel. go-fuse has no callback of nodes
+// for it.
+type forgetNotifier struct {
+	fuse.RawFileSystem
+}
+
+func (f *forgetNotifier) Forget(nodeid, nlookup uint64) {
+	f.RawFileSystem.Forget(nodeid, nlookup)
+	// go-fuse uses the inode numbers as node ids
+	inodes.forget(nodeid)
+}
+
+// Mount mounts root at dir like fs.Mount, removing the inodes forgotten by the
+// kernel from the inode table
+func Mount(dir string, root fs.InodeEmbedder, options *fs.Options) (*fuse.Server, error) {
+	rawFS := &forgetNotifier{fs.NewNodeFS(root, options)}
+	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// GetInode returns a valid inode for npath. If it isn't registered yet, it will
+// be registered
+func GetInode(npath string) uint64 {
+	// clip trailing '/'
+	return inodes.get(trimPath(npath))
+}
+
+// GetInodeIfRegistered returns the inode if it is registered, won't register it
+// if it isn't already registered
+func GetInodeIfRegistered(npath string) (uint64, bool) {
+	return inodes.lookup(trimPath(npath))
+}
+
+// newChildInode creates the inode of the child npath of n and registers it
+// with the inode table. Used by FIOs for returning nodes from Lookup, Create
+// and Mkdir.
+func newChildInode(n *SfsNode, ctx context.Context, npath string, mode uint32, out *fuse.EntryOut) *fs.Inode {
+	ino := inodes.getFor(trimPath(npath), mode)
+	stable := fs.StableAttr{
+		Mode: mode,
+		Ino:  ino,
+	}
+	child := n.NewInode(ctx, NewNode(npath), stable)
+	inodes.attach(trimPath(npath), child)
+	out.NodeId = ino
+	return child
+}
+
+// GetPath returns the node path of inode ino, if it is registered
+func GetPath(ino uint64) (string, bool) {
+	return inodes.path(ino)
+}
@@ -3,11 +3,14 @@ package secretsfs
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers" //SecretsFS FuseHelper
 )
 
 type SfsNode struct {
@@ -22,8 +25,16 @@ func NewNode(npath string) *SfsNode {
 	}
 }
 
+// mountPoint is the absolute path secretsfs is mounted at
+var mountPoint string
+
+// SetMountPoint sets the path secretsfs is mounted at, e.g. for templatefiles
+func SetMountPoint(path string) {
+	mountPoint = path
+}
+
 func GetNewRootNode(npath string, fms map[string]*FIOMap) *SfsNode {
-	_ = GetInode(npath)
+	_ = inodes.pin(trimPath(npath))
 	return &SfsNode{
 		npath: npath,
 		fms:   fms,
@@ -42,7 +53,7 @@ func (n *SfsNode) NPath() string {
 var _ = (fs.NodeReaddirer)((*SfsNode)(nil))
 
 func (n *SfsNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	defer log.WithFields(log.Fields{"pathsInodes": pathsInodes}).Debug("log values")
+	defer log.WithFields(log.Fields{"inodes": inodes.len()}).Debug("log values")
 	log.WithFields(log.Fields{
 		"nType":   fmt.Sprintf("%T", n),
 		"n":       n,
@@ -84,12 +95,12 @@ func (n *SfsNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 }
 
 // Open File
-// This is only used for creating a filehandle. Since I work without FileHandles,
-// just return, and work then with the Read(...) Method
+// FIOs return a filehandle capturing the content of the file at open time, all
+// following reads and getattrs of the open file are served from it.
 var _ = (fs.NodeOpener)((*SfsNode)(nil))
 
 func (n *SfsNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	defer log.WithFields(log.Fields{"pathsInodes": pathsInodes}).Debug("log values")
+	defer log.WithFields(log.Fields{"inodes": inodes.len()}).Debug("log values")
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 	rootpath, _ := rootName(n.npath)
 	fr := getFIORootFromRootPath(rootpath)
@@ -100,7 +111,11 @@ func (n *SfsNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fus
 			"rootpath":     rootpath,
 			"fr":           fr,
 			"fr.FIOPath()": fr.FIOPath()}).Debug("delegating Open to FIORoot")
-		return fr.Open(n, ctx, flags)
+		fh, fuseFlags, errno = fr.Open(n, ctx, flags)
+		if kc := getKernelCache(rootpath); !kc.enabled {
+			fuseFlags |= fuse.FOPEN_DIRECT_IO
+		}
+		return fh, fuseFlags, errno
 	}
 	return nil, 0, 0
 }
@@ -109,7 +124,7 @@ func (n *SfsNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fus
 var _ = (fs.NodeReader)((*SfsNode)(nil))
 
 func (n *SfsNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	defer log.WithFields(log.Fields{"pathsInodes": pathsInodes}).Debug("log values")
+	defer log.WithFields(log.Fields{"inodes": inodes.len()}).Debug("log values")
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 	rootpath, _ := rootName(n.npath)
 	fr := getFIORootFromRootPath(rootpath)
@@ -137,7 +152,7 @@ func (n *SfsNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off i
 var _ = (fs.NodeLookuper)((*SfsNode)(nil))
 
 func (n *SfsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	defer log.WithFields(log.Fields{"pathsInodes": pathsInodes}).Debug("log values")
+	defer log.WithFields(log.Fields{"inodes": inodes.len()}).Debug("log values")
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
 
 	// root nodes
@@ -151,6 +166,7 @@ func (n *SfsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (
 			}
 			operations := NewNode(n.npath + name)
 			child := n.NewPersistentInode(ctx, operations, stable)
+			setEntryAttr(ctx, child, out, false)
 			log.WithFields(log.Fields{
 				"n":          n,
 				"n.npath":    n.npath,
@@ -194,16 +210,21 @@ func (n *SfsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (
 		"subpath":      subpath,
 		"fr":           fr,
 		"fr.FIOPath()": fr.FIOPath()}).Debug("log values")
-	return fr.Lookup(n, ctx, name, out)
+	child, errno := fr.Lookup(n, ctx, name, out)
+	if errno == fs.OK {
+		setEntryAttr(ctx, child, out, false)
+	}
+	return child, errno
 }
 
 // GetAttrer
 var _ = (fs.NodeGetattrer)((*SfsNode)(nil))
 
 func (n *SfsNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	defer log.WithFields(log.Fields{"pathsInodes": pathsInodes}).Debug("log values")
+	defer log.WithFields(log.Fields{"inodes": inodes.len()}).Debug("log values")
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 
+	n.setDefaultAttr(ctx, &out.Attr)
 	if n.npath == "/" { // root
 		return fs.OK
 	}
@@ -224,14 +245,23 @@ func (n *SfsNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrO
 		"rootpath":     rootpath,
 		"fr":           fr,
 		"fr.FIOPath()": fr.FIOPath()}).Debug("log values")
-	return fr.Getattr(n, ctx, fh, out)
+	errno := fr.Getattr(n, ctx, fh, out)
+	if errno != fs.OK {
+		return errno
+	}
+	out.SetTimeout(getKernelCache(rootpath).attr)
+	// open files report the size of the content captured by their filehandle
+	if fg, ok := fh.(fs.FileGetattrer); ok {
+		return fg.Getattr(ctx, out)
+	}
+	return fs.OK
 }
 
 // OnAdder
 var _ = (fs.NodeOnAdder)((*SfsNode)(nil))
 
 func (n *SfsNode) OnAdd(ctx context.Context) {
-	defer log.WithFields(log.Fields{"pathsInodes": pathsInodes}).Debug("log values")
+	defer log.WithFields(log.Fields{"inodes": inodes.len()}).Debug("log values")
 	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
 	if n.fms == nil {
 		log.Println("OnAdd, leaving")
@@ -244,12 +274,233 @@ func (n *SfsNode) OnAdd(ctx context.Context) {
 	}
 	// register all rootPaths in advance, make them persistent
 	for _, rootpath := range RootPathsEnabled() {
-		_ = GetInode("/" + rootpath)
+		_ = inodes.pin("/" + rootpath)
 		log.WithFields(log.Fields{
 			"n":        n,
 			"n.npath":  n.npath,
 			"n.fms":    n.fms,
 			"rootpath": rootpath,
-			"calling":  "GetInode(\"/\" + rootpath)"}).Debug("registered rootpath with OnAdd function")
+			"calling":  "inodes.pin(\"/\" + rootpath)"}).Debug("registered rootpath with OnAdd function")
+	}
+}
+
+// fioRoot returns the FIORoot responsible for n, nil for the root node
+func (n *SfsNode) fioRoot() FIORoot {
+	rootpath, _ := rootName(n.npath)
+	return getFIORootFromRootPath(rootpath)
+}
+
+// kernelCache returns the kernel cache configuration of the FIO responsible
+// for n
+func (n *SfsNode) kernelCache() kernelCache {
+	rootpath, _ := rootName(n.npath)
+	return getKernelCache(rootpath)
+}
+
+// setDefaultAttr sets the calling user as owner of n and the permissions
+// configured for the FIO with fio.<name>.permissions. FIOs may restrict them
+// further in Getattr.
+func (n *SfsNode) setDefaultAttr(ctx context.Context, out *fuse.Attr) {
+	if owner, ok := sfsfh.GetOwnerFromContext(ctx); ok {
+		out.Owner = owner
+	}
+	rootpath, _ := rootName(n.npath)
+	key := "fio." + rootpath + ".permissions."
+	switch {
+	case n.IsDir():
+		out.Mode = out.Mode&syscall.S_IFMT | getPermissions(key+"dir", 0500)
+	case n.Mode()&syscall.S_IFMT == syscall.S_IFLNK:
+		// permissions of symlinks are never checked
+		out.Mode = out.Mode&syscall.S_IFMT | 0777
+	default:
+		out.Mode = out.Mode&syscall.S_IFMT | getPermissions(key+"file", 0400)
+	}
+}
+
+// setEntryAttr sets the attributes and timeouts of the entry of child returned
+// to the kernel. FIOs only fill in the mode of entries, so the attributes are
+// completed with Getattr if complete is set or if the kernel caches them,
+// otherwise the kernel would cache e.g. a size of 0.
+func setEntryAttr(ctx context.Context, child *fs.Inode, out *fuse.EntryOut, complete bool) {
+	cn, ok := child.Operations().(*SfsNode)
+	if !ok {
+		return
+	}
+	kc := cn.kernelCache()
+	out.SetEntryTimeout(kc.entry)
+	if complete || kc.attr > 0 {
+		var attr fuse.AttrOut
+		if errno := cn.Getattr(ctx, nil, &attr); errno == fs.OK {
+			out.Attr = attr.Attr
+			out.Mode = out.Mode&07777 | child.Mode()
+			out.SetAttrTimeout(kc.attr)
+			return
+		}
+	}
+	cn.setDefaultAttr(ctx, &out.Attr)
+}
+
+// Create File
+var _ = (fs.NodeCreater)((*SfsNode)(nil))
+
+func (n *SfsNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return nil, nil, 0, syscall.EROFS
+	}
+	node, fh, fuseFlags, errno = fr.Create(n, ctx, name, flags, mode, out)
+	if errno == fs.OK {
+		setEntryAttr(ctx, node, out, true)
+		if kc := n.kernelCache(); !kc.enabled {
+			fuseFlags |= fuse.FOPEN_DIRECT_IO
+		}
+	}
+	return node, fh, fuseFlags, errno
+}
+
+// Write File
+var _ = (fs.NodeWriter)((*SfsNode)(nil))
+
+func (n *SfsNode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "off": off, "len(data)": len(data)}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return 0, syscall.EROFS
+	}
+	return fr.Write(n, ctx, f, data, off)
+}
+
+// Setattrer
+var _ = (fs.NodeSetattrer)((*SfsNode)(nil))
+
+func (n *SfsNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "in": in}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return syscall.EROFS
+	}
+	errno := fr.Setattr(n, ctx, f, in, out)
+	if errno != fs.OK {
+		return errno
+	}
+	// report the attributes after the change
+	return n.Getattr(ctx, f, out)
+}
+
+// Unlink File
+var _ = (fs.NodeUnlinker)((*SfsNode)(nil))
+
+func (n *SfsNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return syscall.EROFS
+	}
+	errno := fr.Unlink(n, ctx, name)
+	if errno == fs.OK {
+		inodes.remove(filepath.Join(n.npath, name))
+	}
+	return errno
+}
+
+// Mkdir
+var _ = (fs.NodeMkdirer)((*SfsNode)(nil))
+
+func (n *SfsNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return nil, syscall.EROFS
+	}
+	child, errno := fr.Mkdir(n, ctx, name, mode, out)
+	if errno == fs.OK {
+		setEntryAttr(ctx, child, out, true)
+	}
+	return child, errno
+}
+
+// Rmdir
+var _ = (fs.NodeRmdirer)((*SfsNode)(nil))
+
+func (n *SfsNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "name": name}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return syscall.EROFS
+	}
+	errno := fr.Rmdir(n, ctx, name)
+	if errno == fs.OK {
+		inodes.remove(filepath.Join(n.npath, name))
+	}
+	return errno
+}
+
+// Flush File
+// Called on every close of a file, writing FIOs commit buffered writes here.
+var _ = (fs.NodeFlusher)((*SfsNode)(nil))
+
+func (n *SfsNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return fs.OK
+	}
+	return fr.Flush(n, ctx, f)
+}
+
+// Readlink
+// FIOs without symlinks embed FIONoSymlinks.
+var _ = (fs.NodeReadlinker)((*SfsNode)(nil))
+
+func (n *SfsNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return nil, syscall.EINVAL
+	}
+	return fr.Readlink(n, ctx)
+}
+
+// Extended Attributes
+// FIOs without extended attributes embed FIONoXattr.
+var _ = (fs.NodeGetxattrer)((*SfsNode)(nil))
+var _ = (fs.NodeListxattrer)((*SfsNode)(nil))
+var _ = (fs.NodeSetxattrer)((*SfsNode)(nil))
+var _ = (fs.NodeRemovexattrer)((*SfsNode)(nil))
+
+func (n *SfsNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "attr": attr}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return 0, syscall.ENODATA
+	}
+	return fr.Getxattr(n, ctx, attr, dest)
+}
+
+func (n *SfsNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return 0, fs.OK
+	}
+	return fr.Listxattr(n, ctx, dest)
+}
+
+func (n *SfsNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "attr": attr, "flags": flags}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return syscall.ENOTSUP
+	}
+	return fr.Setxattr(n, ctx, attr, data, flags)
+}
+
+func (n *SfsNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	log.WithFields(log.Fields{"n": n, "n.npath": n.npath, "attr": attr}).Debug("log values")
+	fr := n.fioRoot()
+	if fr == nil {
+		return syscall.ENODATA
 	}
+	return fr.Removexattr(n, ctx, attr)
 }
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// cachingStore is a Store caching the secrets returned by another Store, so
+// that listing a directory doesn't request every entry from the backend
+// multiple times. Secrets are cached per calling user, a user is never served
+// secrets read with the permissions of another user.
+type cachingStore struct {
+	store       Store
+	ttl         time.Duration // ttl of found secrets
+	negativeTTL time.Duration // ttl of secrets not found, 0 disables negative caching
+	maxEntries  int
+
+	mu         sync.Mutex
+	entries    map[cacheKey]*cacheEntry
+	calls      map[cacheKey]*cacheCall // requests to the store in flight
+	generation uint64                  // incremented on every invalidation
+}
+
+var _ = (Store)((*cachingStore)(nil))
+
+// cacheKey identifies a secret read by a user. spath is the canonical path
+// of the secret, see canonicalPath, so that all paths of a secret share the
+// same entry.
+type cacheKey struct {
+	uid   string
+	spath string
+}
+
+// cacheEntry is a cached result of GetSecret, paths of secret are those of
+// the request fetching it
+type cacheEntry struct {
+	secret  *Secret
+	err     error // only ErrNotFound is cached
+	expires time.Time
+}
+
+// cacheCall is a request to the store in flight, concurrent identical
+// requests wait for it instead of sending their own request
+type cacheCall struct {
+	done   chan struct{}
+	secret *Secret
+	err    error
+}
+
+// newCachingStore returns s wrapped in a cachingStore configured with
+// store.cache.*
+func newCachingStore(s Store) *cachingStore {
+	return &cachingStore{
+		store:       s,
+		ttl:         viper.GetDuration("store.cache.ttl"),
+		negativeTTL: viper.GetDuration("store.cache.negativettl"),
+		maxEntries:  viper.GetInt("store.cache.maxentries"),
+		entries:     make(map[cacheKey]*cacheEntry),
+		calls:       make(map[cacheKey]*cacheCall),
+	}
+}
+
+// GetSecret returns the cached secret at spath, if the calling user read it
+// within the ttl. Otherwise it is read from the wrapped store.
+func (c *cachingStore) GetSecret(spath string, ctx context.Context) (*Secret, error) {
+	return c.get(canonicalPath(c.store, spath), spath, ctx, func() (*Secret, error) {
+		return c.store.GetSecret(spath, ctx)
+	})
+}
+
+// GetVersions isn't cached, as new versions are written outside of secretsfs
+func (c *cachingStore) GetVersions(spath string, ctx context.Context) ([]int, error) {
+	return c.store.GetVersions(spath, ctx)
+}
+
+// GetSecretVersion returns the cached version of the secret at spath like
+// GetSecret
+func (c *cachingStore) GetSecretVersion(spath string, version int, ctx context.Context) (*Secret, error) {
+	key := canonicalPath(c.store, spath) + versionSeparator + strconv.Itoa(version)
+	return c.get(key, spath, ctx, func() (*Secret, error) {
+		return c.store.GetSecretVersion(spath, version, ctx)
+	})
+}
+
+// versionSeparator separates the path of a secret from its version in the
+// cached paths of versions
+const versionSeparator = "?version="
+
+// get returns the cached secret with the canonical path kpath, if the
+// calling user read it within the ttl. Otherwise it is read with fetch. The
+// paths of the returned secret start with the requested spath.
+func (c *cachingStore) get(kpath, spath string, ctx context.Context, fetch func() (*Secret, error)) (*Secret, error) {
+	uid, ok := callerUid(ctx)
+	if !ok {
+		return fetch()
+	}
+	key := cacheKey{uid: uid, spath: kpath}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		if time.Now().Before(e.expires) {
+			c.mu.Unlock()
+			log.WithFields(log.Fields{"uid": uid, "spath": spath}).Trace("serving secret from cache")
+			return copySecret(e.secret, spath), e.err
+		}
+		delete(c.entries, key)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return copySecret(call.secret, spath), call.err
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	call.secret, call.err = fetch()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	// don't cache secrets read before they were changed
+	if generation == c.generation {
+		c.add(key, call.secret, call.err)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return copySecret(call.secret, spath), call.err
+}
+
+// PutSecret writes sec to the wrapped store and invalidates all cached
+// entries affected by it
+func (c *cachingStore) PutSecret(sec *Secret, ctx context.Context) error {
+	defer c.invalidate(sec.Path)
+	return c.store.PutSecret(sec, ctx)
+}
+
+// DeleteSecret deletes sec from the wrapped store and invalidates all cached
+// entries affected by it
+func (c *cachingStore) DeleteSecret(sec *Secret, ctx context.Context) error {
+	defer c.invalidate(sec.Path)
+	return c.store.DeleteSecret(sec, ctx)
+}
+
+// CheckWrite checks the permissions in the wrapped store, see CheckWrite
+func (c *cachingStore) CheckWrite(sec *Secret, ctx context.Context) error {
+	return CheckWrite(c.store, sec, ctx)
+}
+
+// GetMetadata isn't cached, metadata is only requested explicitly by users
+func (c *cachingStore) GetMetadata(sec *Secret, ctx context.Context) (Metadata, error) {
+	return c.store.GetMetadata(sec, ctx)
+}
+
+func (c *cachingStore) PutMetadata(sec *Secret, name, value string, ctx context.Context) error {
+	return c.store.PutMetadata(sec, name, value, ctx)
+}
+
+func (c *cachingStore) DeleteMetadata(sec *Secret, name string, ctx context.Context) error {
+	return c.store.DeleteMetadata(sec, name, ctx)
+}
+
+func (c *cachingStore) String() string {
+	return c.store.String()
+}
+
+// Unwrap returns the wrapped store
+func (c *cachingStore) Unwrap() Store {
+	return c.store
+}
+
+// Generation returns the number of invalidations, it changes whenever
+// secrets are written through the cache
+func (c *cachingStore) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// add caches the result of GetSecret. Must have c.mu.
+func (c *cachingStore) add(key cacheKey, sec *Secret, err error) {
+	ttl := c.ttl
+	if errors.Is(err, ErrNotFound) {
+		ttl = c.negativeTTL
+	} else if err != nil {
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = &cacheEntry{secret: sec, err: err, expires: time.Now().Add(ttl)}
+}
+
+// evict removes all expired entries. If none expired, the entry expiring
+// next is removed. Must have c.mu.
+func (c *cachingStore) evict() {
+	now := time.Now()
+	var next cacheKey
+	var nextExpires time.Time
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		} else if nextExpires.IsZero() || e.expires.Before(nextExpires) {
+			next, nextExpires = key, e.expires
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		delete(c.entries, next)
+	}
+}
+
+// invalidate removes the cached entries of all users for spath, its parent
+// listing it and all secrets below it
+func (c *cachingStore) invalidate(spath string) {
+	spath = canonicalPath(c.store, spath)
+	parent := path.Dir(spath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key := range c.entries {
+		kpath := key.spath
+		if i := strings.Index(kpath, versionSeparator); i >= 0 {
+			kpath = kpath[:i]
+		}
+		if kpath == spath || kpath == parent || strings.HasPrefix(kpath, spath+"/") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// callerUid returns the uid of the user calling the filesystem operation
+func callerUid(ctx context.Context) (string, bool) {
+	c, ok := ctx.(*fuse.Context)
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatUint(uint64(c.Caller.Uid), 10), true
+}
+
+// copySecret returns a deep copy of sec, so that callers modifying the
+// returned secret, its subs or their contents don't modify the cached one.
+// The paths of the copy are moved from sec.Path to spath, as sec may have been
+// read by another path of the same secret.
+func copySecret(sec *Secret, spath string) *Secret {
+	if sec == nil {
+		return nil
+	}
+	from := sec.Path
+	var cp func(sec *Secret) *Secret
+	cp = func(sec *Secret) *Secret {
+		c := *sec
+		c.Path = movePath(sec.Path, from, spath)
+		c.Content = append([]byte(nil), sec.Content...)
+		c.Subs = nil
+		for _, sub := range sec.Subs {
+			c.Subs = append(c.Subs, cp(sub))
+		}
+		return &c
+	}
+	return cp(sec)
+}
+
+// movePath returns p, which is from or located below it, relative to to
+// instead
+func movePath(p, from, to string) string {
+	if from == to {
+		return p
+	}
+	if p == from {
+		return to
+	}
+	prefix := strings.Trim(from, "/")
+	if rel := strings.TrimPrefix(strings.Trim(p, "/"), prefix+"/"); prefix != "" && rel != strings.Trim(p, "/") {
+		return path.Join(to, rel)
+	}
+	return p
+}
+
+// canonicalPath returns the path identifying the secret spath in s, if s
+// resolves different paths to the same secret, e.g. the name and the path of
+// a mount. Otherwise spath is only trimmed.
+func canonicalPath(s Store, spath string) string {
+	r, ok := s.(interface{ canonicalPath(string) string })
+	if !ok {
+		return strings.Trim(spath, "/")
+	}
+	return r.canonicalPath(spath)
+}
+
+// Generation returns a number changing whenever secrets are written through s,
+// if s counts the writes, e.g. the cache. Data derived from secrets, e.g.
+// rendered templatefiles, is outdated if it changed.
+func Generation(s Store) (uint64, bool) {
+	g, ok := s.(interface{ Generation() uint64 })
+	if !ok {
+		return 0, false
+	}
+	return g.Generation(), true
+}
+
+// Unwrap returns the store wrapped by s, e.g. by the cache, or s itself if it
+// doesn't wrap another store
+func Unwrap(s Store) Store {
+	for {
+		w, ok := s.(interface{ Unwrap() Store })
+		if !ok {
+			return s
+		}
+		s = w.Unwrap()
+	}
+}
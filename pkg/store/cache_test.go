@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// countingStore returns a secret for every path except "missing" and counts
+// the requests per path
+type countingStore struct {
+	mu      sync.Mutex
+	calls   map[string]int
+	release chan struct{} // blocks GetSecret until closed, if set
+}
+
+func (s *countingStore) GetSecret(spath string, ctx context.Context) (*Secret, error) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	s.calls[spath]++
+	s.mu.Unlock()
+	if spath == "missing" {
+		return nil, NewError(ErrNotFound, errors.New("no such secret"))
+	}
+	uid, _ := callerUid(ctx)
+	return &Secret{Path: spath, Content: []byte(uid), Subs: []*Secret{{Path: spath + "/key", Content: []byte(uid)}}}, nil
+}
+
+func (s *countingStore) PutSecret(sec *Secret, ctx context.Context) error    { return nil }
+func (s *countingStore) DeleteSecret(sec *Secret, ctx context.Context) error { return nil }
+func (s *countingStore) GetMetadata(sec *Secret, ctx context.Context) (Metadata, error) {
+	return nil, nil
+}
+func (s *countingStore) PutMetadata(sec *Secret, name, value string, ctx context.Context) error {
+	return nil
+}
+func (s *countingStore) DeleteMetadata(sec *Secret, name string, ctx context.Context) error {
+	return nil
+}
+func (s *countingStore) GetVersions(spath string, ctx context.Context) ([]int, error) {
+	return nil, nil
+}
+func (s *countingStore) GetSecretVersion(spath string, version int, ctx context.Context) (*Secret, error) {
+	return s.GetSecret(spath, ctx)
+}
+func (s *countingStore) String() string { return "counting" }
+
+// mountStore is a countingStore with the mount path "secret" named "kv"
+type mountStore struct {
+	*countingStore
+}
+
+func (s mountStore) canonicalPath(spath string) string {
+	spath = strings.Trim(spath, "/")
+	if spath == "secret" || strings.HasPrefix(spath, "secret/") {
+		return "kv" + strings.TrimPrefix(spath, "secret")
+	}
+	return spath
+}
+
+func callerContext(uid uint32) *fuse.Context {
+	return &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uid}}}
+}
+
+func TestCachingStore(t *testing.T) {
+	s := &countingStore{calls: make(map[string]int)}
+	c := newCachingStore(s)
+	c.ttl, c.negativeTTL, c.maxEntries = time.Minute, time.Minute, 10
+
+	alice, bob := callerContext(1000), callerContext(1001)
+	tables := []struct {
+		ctx     context.Context
+		spath   string
+		content string
+		err     error
+		calls   int
+	}{
+		{alice, "app/db", "1000", nil, 1},
+		{alice, "app/db/", "1000", nil, 1},
+		{bob, "app/db", "1001", nil, 2},
+		{alice, "missing", "", ErrNotFound, 1},
+		{alice, "missing", "", ErrNotFound, 1},
+	}
+
+	for _, table := range tables {
+		sec, err := c.GetSecret(table.spath, table.ctx)
+		if !errors.Is(err, table.err) {
+			t.Errorf("error of '%v' was incorrect, got: '%v', want: '%v'\n", table.spath, err, table.err)
+		}
+		if err == nil && string(sec.Content) != table.content {
+			t.Errorf("content of '%v' was incorrect, got: '%v', want: '%v'\n", table.spath, sec.Content, table.content)
+		}
+		if calls := s.calls[table.spath]; calls > table.calls {
+			t.Errorf("calls of '%v' were incorrect, got: '%v', want: '%v'\n", table.spath, calls, table.calls)
+		}
+	}
+
+	// writing a key invalidates the secret listing it
+	c.PutSecret(&Secret{Path: "app/db/password"}, alice)
+	c.GetSecret("app/db", alice)
+	if calls := s.calls["app/db"]; calls != 3 {
+		t.Errorf("calls of 'app/db' after writing were incorrect, got: '%v', want: '3'\n", calls)
+	}
+}
+
+func TestCachingStorePaths(t *testing.T) {
+	s := &countingStore{calls: make(map[string]int)}
+	c := newCachingStore(mountStore{s})
+	c.ttl = time.Minute
+	alice := callerContext(1000)
+	calls := func() int {
+		return s.calls["kv/app"] + s.calls["secret/app"]
+	}
+
+	tables := []struct {
+		name   string
+		change func()
+		spath  string
+		calls  int
+	}{
+		{"by name", func() {}, "kv/app", 1},
+		{"by path", func() {}, "secret/app", 1},
+		{"modified copy", func() {
+			sec, _ := c.GetSecret("secret/app", alice)
+			sec.Subs[0].Path = "changed"
+			sec.Subs[0].Content[0] = 'x'
+		}, "kv/app", 1},
+		{"written by path", func() { c.PutSecret(&Secret{Path: "secret/app/key"}, alice) }, "kv/app", 2},
+		{"written by name", func() { c.PutSecret(&Secret{Path: "kv/app/key"}, alice) }, "secret/app", 3},
+	}
+
+	for _, table := range tables {
+		table.change()
+		sec, err := c.GetSecret(table.spath, alice)
+		if err != nil || sec.Path != table.spath || len(sec.Subs) != 1 || sec.Subs[0].Path != table.spath+"/key" || string(sec.Subs[0].Content) != "1000" || calls() != table.calls {
+			t.Errorf("getting %s was incorrect, got: %+v, %v, %d calls, want: %s with key, %d calls.", table.name, sec, err, calls(), table.spath, table.calls)
+		}
+	}
+}
+
+func TestCachingStoreSingleflight(t *testing.T) {
+	s := &countingStore{calls: make(map[string]int), release: make(chan struct{})}
+	c := newCachingStore(s)
+	c.ttl = time.Minute
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.GetSecret("app/db", callerContext(1000))
+		}()
+	}
+	// wait until all requests are waiting for the first one
+	for {
+		c.mu.Lock()
+		n := len(c.calls)
+		c.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	if calls := s.calls["app/db"]; calls != 1 {
+		t.Errorf("concurrent requests weren't collapsed, got: '%v' calls, want: '1'\n", calls)
+	}
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"errors"
+)
+
+// Typed errors returned by stores. Errors returned by a Store may be checked
+// against them with errors.Is, so that callers can distinguish a missing
+// secret from an unreachable backend.
+var (
+	// ErrNotFound is returned if the secret does not exist
+	ErrNotFound = errors.New("secret not found")
+	// ErrPermissionDenied is returned if the user may not access the secret
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrAuthFailed is returned if the store rejected the user's credentials,
+	// e.g. because they are expired
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrNoCredentials is returned if no credentials are available for the
+	// user, e.g. because the credentials file is missing
+	ErrNoCredentials = errors.New("no credentials available")
+	// ErrUnavailable is returned if the backend could not be reached or is
+	// not able to serve requests
+	ErrUnavailable = errors.New("store unavailable")
+	// ErrTimeout is returned if the backend did not answer in time
+	ErrTimeout = errors.New("store timed out")
+	// ErrExists is returned if a secret to be created already exists
+	ErrExists = errors.New("secret already exists")
+	// ErrNotEmpty is returned if a secret to be deleted still contains keys or
+	// further secrets
+	ErrNotEmpty = errors.New("secret not empty")
+	// ErrNotSupported is returned if the store can not perform an operation,
+	// e.g. writing to a read only store
+	ErrNotSupported = errors.New("operation not supported by store")
+)
+
+// storeError is an error of a backend classified as one of the typed errors
+type storeError struct {
+	kind error
+	err  error
+}
+
+func (e *storeError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
+
+func (e *storeError) Is(target error) bool {
+	return target == e.kind
+}
+
+// NewError classifies err of a backend as kind, which is one of the typed
+// errors like ErrNotFound. The original error is kept and can still be
+// inspected with errors.As. Returns nil if err is nil and err itself if it is
+// already classified as kind.
+func NewError(kind, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &storeError{kind: kind, err: err}
+}
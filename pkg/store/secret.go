@@ -3,6 +3,15 @@ package store
 type Secret struct {
 	Path    string
 	Mode    int64
-	Content string
+	Content []byte
 	Subs    []*Secret
+	// HasKeys is set on directories, which are secrets that may contain keys,
+	// rather than only paths containing further secrets. Stores set it on
+	// Subs, if they know it from the listing without reading every secret.
+	HasKeys bool
 }
+
+// Metadata contains the metadata of a secret mapped to their names, e.g.
+// "version" or "custom_metadata.<key>". Which names are available depends on
+// the store.
+type Metadata map[string]string
@@ -2,15 +2,21 @@ package store
 
 import (
 	"context"
-	//"github.com/hanwen/go-fuse/v2/fs"
-	//"github.com/hanwen/go-fuse/v2/fuse"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
 )
 
-// store contains the registered Store
+// store contains the active Store, chosen with InitStore
 var store Store
 
-// available stores
-var stores []string
+// factories contains all registered store factories mapped to their names
+var factories map[string]Factory = make(map[string]Factory)
+
+// Factory creates a new instance of a Store.
+// It is called at mount time for the store configured in store.enabled.
+type Factory func() (Store, error)
 
 // GetStore returns currently active Store Implementation
 func GetStore() *Store {
@@ -21,31 +27,97 @@ func GetStore() *Store {
 // Registered stores are all available stores that a user may configure as a
 // store of secretsfs.
 func GetStores() []string {
-	return stores
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-// RegisterStore registers available stores
-// if a store is also set to be the backend store it will be set here
-func RegisterStore(s Store) {
-	stores = append(stores, s.String())
-	// TODO: make store configurable
-	if s.String() == "vault_kv" {
-		store = s
+// RegisterStore registers the factory of an available store under name.
+// To be used inside of init() function of store implementations.
+func RegisterStore(name string, f Factory) {
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("store %q is already registered", name))
 	}
-	//if viper.GetString("store.enabled") == s.String() {
-	//	store = s
-	//}
+	factories[name] = f
+}
+
+// InitStore creates the store configured with store.enabled and sets it as
+// the currently active Store. It is wrapped in a cache, if store.cache.ttl is
+// set.
+// Returns an error if no store is registered under the configured name.
+func InitStore() error {
+	name := viper.GetString("store.enabled")
+	f, ok := factories[name]
+	if !ok {
+		return fmt.Errorf("store %q configured in store.enabled is not available, available stores are: %v", name, GetStores())
+	}
+	s, err := f()
+	if err != nil {
+		return fmt.Errorf("could not create store %q: %v", name, err)
+	}
+	if viper.GetDuration("store.cache.ttl") > 0 {
+		s = newCachingStore(s)
+	}
+	SetStore(s)
+	return nil
+}
+
+// SetStore sets s as the currently active Store.
+func SetStore(s Store) {
+	store = s
+}
+
+// CheckWrite returns ErrPermissionDenied, if the calling user may not write
+// sec to s, without writing it. Stores that can't check permissions in advance
+// return nil, their errors are returned when writing.
+func CheckWrite(s Store, sec *Secret, ctx context.Context) error {
+	c, ok := s.(interface {
+		CheckWrite(sec *Secret, ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return c.CheckWrite(sec, ctx)
 }
 
 // Store interface describes functions a new store should implement.
+// Errors of the backend should be classified with NewError as one of the typed
+// errors like ErrNotFound, so that they are returned with the matching errno.
 type Store interface {
-	// for convenience
+	// GetSecret returns the secret, path or key at spath. Keys of a secret are
+	// returned as Subs including their Content.
 	GetSecret(spath string, ctx context.Context) (secret *Secret, err error)
 
+	// PutSecret writes sec. If sec is a file, its Content is written as value
+	// of the key at sec.Path, if it is a directory, an empty secret is created
+	// at sec.Path.
+	PutSecret(sec *Secret, ctx context.Context) error
+
+	// DeleteSecret deletes sec. If sec is a file, the key at sec.Path is
+	// removed, if it is a directory, the secret at sec.Path is removed, which
+	// must not contain any keys or further secrets.
+	DeleteSecret(sec *Secret, ctx context.Context) error
+
+	// GetMetadata returns the metadata of sec. If sec is a file, the metadata
+	// of the secret containing the key is returned.
+	GetMetadata(sec *Secret, ctx context.Context) (Metadata, error)
+
+	// PutMetadata sets the metadata name of sec to value, DeleteMetadata
+	// removes it. Stores may only support changing some of the metadata.
+	PutMetadata(sec *Secret, name, value string, ctx context.Context) error
+	DeleteMetadata(sec *Secret, name string, ctx context.Context) error
+
+	// GetVersions returns the versions of the secret spath, which can still be
+	// read, in ascending order. Secrets without versions return none.
+	GetVersions(spath string, ctx context.Context) ([]int, error)
+
+	// GetSecretVersion returns version of the secret spath. Its keys are
+	// returned as Subs including their Content.
+	GetSecretVersion(spath string, version int, ctx context.Context) (*Secret, error)
+
 	// String() is used to distinguish between different store implementations
 	String() string
 }
-
-func init() {
-	stores = []string{}
-}
@@ -0,0 +1,576 @@
+package store
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// AuthMethod describes how a user logs in to vault.
+type AuthMethod interface {
+	// Login logs in user u with client c and returns the auth info containing
+	// the new token and its lease
+	Login(c *api.Client, u *user.User) (*api.SecretAuth, error)
+
+	// Stamp identifies the credentials of user u. Whenever the credentials
+	// change, their stamp changes as well and the user is logged in again.
+	Stamp(u *user.User) (string, error)
+
+	// String() is the name used for configuring the auth method
+	String() string
+}
+
+// authMethods contains all registered AuthMethods mapped to their names
+var authMethods map[string]AuthMethod = make(map[string]AuthMethod)
+
+// RegisterAuthMethod registers an AuthMethod, so that it may be configured
+// with store.vault.auth.method
+func RegisterAuthMethod(a AuthMethod) {
+	authMethods[a.String()] = a
+}
+
+// GetAuthMethods returns the names of all registered AuthMethods
+func GetAuthMethods() []string {
+	names := make([]string, 0, len(authMethods))
+	for name := range authMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getAuthMethod returns the AuthMethod configured for user u.
+// store.vault.auth.useroverride takes precedence over store.vault.auth.method.
+func getAuthMethod(u *user.User) (AuthMethod, error) {
+	name := viper.GetString("store.vault.auth.method")
+	if override, ok := viper.GetStringMapString("store.vault.auth.useroverride")[u.Username]; ok {
+		name = override
+	}
+	a, ok := authMethods[name]
+	if !ok {
+		return nil, fmt.Errorf("auth method %q configured for user %s is not available, available auth methods are: %v", name, u.Username, GetAuthMethods())
+	}
+	return a, nil
+}
+
+// userFilePath returns the path configured in <key>.file, or the one in
+// <key>.useroverride for user u. $HOME is substituted with the user's home
+// directory.
+func userFilePath(key string, u *user.User) string {
+	spath := viper.GetString(key + ".file")
+	overriddenusers := viper.GetStringMapString(key + ".useroverride")
+	log.WithFields(log.Fields{
+		"key":            key,
+		"username":       u.Username,
+		"overridenusers": overriddenusers}).Debug("log values")
+	if newpath, ok := overriddenusers[u.Username]; ok {
+		spath = newpath
+	}
+	return strings.Replace(spath, "$HOME", u.HomeDir, 1)
+}
+
+// maxUserFileSize limits the size of credentials files read
+const maxUserFileSize = 1 << 20
+
+// readUserFile returns the lines of the file spath belonging to user u
+func readUserFile(spath string, u *user.User) ([]string, error) {
+	o, err := readUserFileContent(spath, u)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(o), "\n"), "\n"), nil
+}
+
+// readUserFileContent returns the content of the file spath belonging to user
+// u, the file is checked like by openUserFile
+func readUserFileContent(spath string, u *user.User) ([]byte, error) {
+	f, _, err := openUserFile(spath, u)
+	if err == nil {
+		defer f.Close()
+	}
+	var o []byte
+	if err == nil {
+		o, err = ioutil.ReadAll(io.LimitReader(f, maxUserFileSize))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": u.Username,
+			"spath":    spath,
+			"error":    err}).Error("could not read credentials file of user")
+		return nil, err
+	}
+	return o, nil
+}
+
+// openUserFile opens the credentials file spath of user u. Files inside of
+// the home directory of u are controlled by the user, so they must not be
+// symlinks, must belong to u and must not be writable by others. Otherwise
+// users could log in with the credentials of other users or of the host by
+// linking them into their home directory, as secretsfs reads them as root.
+// This applies to all files inside of the home directory, no matter where they
+// are configured.
+func openUserFile(spath string, u *user.User) (*os.File, os.FileInfo, error) {
+	owned := inHomeDir(spath, u)
+	// don't block on fifos
+	flags := os.O_RDONLY | syscall.O_NONBLOCK
+	if owned {
+		flags |= syscall.O_NOFOLLOW
+	}
+	f, err := os.OpenFile(spath, flags, 0)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, nil, NewError(ErrNoCredentials, fmt.Errorf("credentials file %s of user %s is a symlink", spath, u.Username))
+	} else if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = NewError(ErrNoCredentials, fmt.Errorf("credentials file %s is not a regular file", spath))
+	}
+	if err == nil && owned {
+		err = checkFileOwner(fi, u)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// checkFileOwner returns an error, if the file fi doesn't belong to user u or
+// is writable by others
+func checkFileOwner(fi os.FileInfo, u *user.User) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || strconv.FormatUint(uint64(st.Uid), 10) != u.Uid {
+		return NewError(ErrNoCredentials, fmt.Errorf("credentials file %s doesn't belong to user %s", fi.Name(), u.Username))
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return NewError(ErrNoCredentials, fmt.Errorf("credentials file %s of user %s is writable by others", fi.Name(), u.Username))
+	}
+	return nil
+}
+
+// inHomeDir returns whether spath is inside of the home directory of user u
+func inHomeDir(spath string, u *user.User) bool {
+	home := filepath.Clean(u.HomeDir)
+	if u.HomeDir == "" || home == "/" {
+		return false
+	}
+	return strings.HasPrefix(filepath.Clean(spath), home+"/")
+}
+
+// fileStamp identifies the state of the files spaths of user u, if any of the
+// files is changed, its stamp changes as well. Empty paths are ignored. The
+// files are checked like by openUserFile.
+func fileStamp(u *user.User, spaths ...string) (string, error) {
+	var stamps []string
+	for _, spath := range spaths {
+		if spath == "" {
+			continue
+		}
+		f, fi, err := openUserFile(spath, u)
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+		stamps = append(stamps, fmt.Sprintf("%s:%d:%d", spath, fi.ModTime().UnixNano(), fi.Size()))
+	}
+	return strings.Join(stamps, ","), nil
+}
+
+// approleAuth logs in with role_id and optional secret_id read from files.
+// The secret_id may be response wrapped.
+type approleAuth struct {
+	mu sync.Mutex
+	// unwrapped contains unwrapped secret_ids mapped to the stamps of their
+	// files, as wrapping tokens may only be unwrapped once
+	unwrapped map[string]string
+}
+
+func (a *approleAuth) Login(c *api.Client, u *user.User) (*api.SecretAuth, error) {
+	// Read approleId from configfile
+	approleId, err := getApproleId(u)
+	if err != nil {
+		return nil, err
+	}
+	secretId, err := a.getSecretId(c, u)
+	if err != nil {
+		return nil, err
+	}
+	return VaultApproleLogin(c, approleId, secretId)
+}
+
+func (a *approleAuth) Stamp(u *user.User) (string, error) {
+	return fileStamp(u, FinIdPath(u), SecretIdPath(u))
+}
+
+func (a *approleAuth) String() string {
+	return "approle"
+}
+
+// getSecretId returns the secret_id of user u, empty if none is configured.
+// Wrapped secret_ids are unwrapped with client c.
+func (a *approleAuth) getSecretId(c *api.Client, u *user.User) (string, error) {
+	spath := SecretIdPath(u)
+	if spath == "" {
+		return "", nil
+	}
+	lines, err := readUserFile(spath, u)
+	if err != nil {
+		return "", err
+	}
+	if !viper.GetBool("store.vault.secretid.wrapped") {
+		return lines[0], nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stamp, err := fileStamp(u, spath)
+	if err != nil {
+		return "", err
+	}
+	if secretId, ok := a.unwrapped[stamp]; ok {
+		return secretId, nil
+	}
+	s, err := c.Logical().Unwrap(lines[0])
+	// Unwrap uses the wrapping token as token of c, if c has none
+	c.ClearToken()
+	if err != nil {
+		return "", fmt.Errorf("could not unwrap secret_id of %s: %v", spath, err)
+	}
+	if s == nil || s.Data == nil {
+		return "", fmt.Errorf("wrapping token of %s contained no data", spath)
+	}
+	secretId, ok := s.Data["secret_id"].(string)
+	if !ok {
+		return "", fmt.Errorf("wrapping token of %s contained no secret_id", spath)
+	}
+	a.unwrapped[stamp] = secretId
+	return secretId, nil
+}
+
+func getApproleId(u *user.User) (authToken string, err error) {
+	spath := FinIdPath(u)
+	log.WithFields(log.Fields{
+		"username": u.Username,
+		"spath":    spath}).Debug("log values")
+	lines, err := readUserFile(spath, u)
+	if err != nil {
+		return "", err
+	}
+	return lines[0], nil
+}
+
+// FinIdPath returns the path of the approleId file of user u
+func FinIdPath(u *user.User) (spath string) {
+	return userFilePath("store.vault.roleid", u)
+}
+
+// SecretIdPath returns the path of the secret_id file of user u, empty if
+// the approle needs no secret_id
+func SecretIdPath(u *user.User) (spath string) {
+	return userFilePath("store.vault.secretid", u)
+}
+
+// VaultApproleLogin logs in with approleId and secretId and returns the auth
+// info containing the accessToken and its lease. secretId may be empty for
+// approles with bind_secret_id=false.
+func VaultApproleLogin(c *api.Client, approleId, secretId string) (*api.SecretAuth, error) {
+	data := map[string]interface{}{
+		"role_id": approleId,
+	}
+	if secretId != "" {
+		data["secret_id"] = secretId
+	}
+	resp, err := c.Logical().Write("auth/approle/login", data)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Auth == nil {
+		return nil, errors.New("no auth info returned")
+	}
+	return resp.Auth, nil
+}
+
+// tokenAuth uses an existing token read from a file, e.g. the token helper
+// file $HOME/.vault-token written by 'vault login'
+type tokenAuth struct{}
+
+func (a *tokenAuth) Login(c *api.Client, u *user.User) (*api.SecretAuth, error) {
+	lines, err := readUserFile(userFilePath("store.vault.token", u), u)
+	if err != nil {
+		return nil, err
+	}
+	c.SetToken(lines[0])
+	s, err := c.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errors.New("no token info returned")
+	}
+	ttl, err := s.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	renewable, err := s.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	return &api.SecretAuth{
+		ClientToken:   lines[0],
+		LeaseDuration: int(ttl.Seconds()),
+		Renewable:     renewable,
+	}, nil
+}
+
+func (a *tokenAuth) Stamp(u *user.User) (string, error) {
+	return fileStamp(u, userFilePath("store.vault.token", u))
+}
+
+func (a *tokenAuth) String() string {
+	return "token"
+}
+
+// passwordAuth logs in with username and password read from a file.
+// The file contains the password, optionally preceded by a line containing
+// the username. If no username is given, the name of the user is used.
+// Used for the auth methods userpass and ldap.
+type passwordAuth struct {
+	name string
+}
+
+func (a *passwordAuth) Login(c *api.Client, u *user.User) (*api.SecretAuth, error) {
+	lines, err := readUserFile(userFilePath(a.key(), u), u)
+	if err != nil {
+		return nil, err
+	}
+	username, password := u.Username, lines[0]
+	if len(lines) > 1 {
+		username, password = lines[0], lines[1]
+	}
+	mount := strings.Trim(viper.GetString(a.key()+".mount"), "/")
+	data := map[string]interface{}{
+		"password": password,
+	}
+	resp, err := c.Logical().Write("auth/"+mount+"/login/"+username, data)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Auth == nil {
+		return nil, errors.New("no auth info returned")
+	}
+	return resp.Auth, nil
+}
+
+func (a *passwordAuth) Stamp(u *user.User) (string, error) {
+	return fileStamp(u, userFilePath(a.key(), u))
+}
+
+func (a *passwordAuth) String() string {
+	return a.name
+}
+
+// key returns the configuration key of the auth method
+func (a *passwordAuth) key() string {
+	return "store.vault." + a.name
+}
+
+// jwtAuth logs in with a role and a JWT read from a file, e.g. the token of a
+// kubernetes service account. Used for the auth methods kubernetes and jwt.
+type jwtAuth struct {
+	name string
+}
+
+func (a *jwtAuth) Login(c *api.Client, u *user.User) (*api.SecretAuth, error) {
+	lines, err := readUserFile(userFilePath(a.key(), u), u)
+	if err != nil {
+		return nil, err
+	}
+	mount := strings.Trim(viper.GetString(a.key()+".mount"), "/")
+	data := map[string]interface{}{
+		"role": viper.GetString(a.key() + ".role"),
+		"jwt":  lines[0],
+	}
+	resp, err := c.Logical().Write("auth/"+mount+"/login", data)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Auth == nil {
+		return nil, errors.New("no auth info returned")
+	}
+	return resp.Auth, nil
+}
+
+// Stamp changes whenever the JWT is rotated, e.g. by kubernetes for projected
+// service account tokens
+func (a *jwtAuth) Stamp(u *user.User) (string, error) {
+	return fileStamp(u, userFilePath(a.key(), u))
+}
+
+func (a *jwtAuth) String() string {
+	return a.name
+}
+
+// key returns the configuration key of the auth method
+func (a *jwtAuth) key() string {
+	return "store.vault." + a.name
+}
+
+// certFiles contains the paths of a client certificate and its private key
+type certFiles struct {
+	CertFile string `mapstructure:"certfile"`
+	KeyFile  string `mapstructure:"keyfile"`
+}
+
+// certAuth logs in with a TLS client certificate, e.g. the machine certificate
+// of a host. Certificates are configured in store.vault.cert, per user in
+// store.vault.cert.useroverride and per group in store.vault.cert.groupoverride.
+type certAuth struct{}
+
+func (a *certAuth) Login(c *api.Client, u *user.User) (*api.SecretAuth, error) {
+	cf, err := certPaths(u)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadClientCert(cf, u)
+	if err != nil {
+		return nil, err
+	}
+	// the certificate is only presented for the login, the token is used with
+	// the transport configured in store.vault.tls afterwards
+	tc := tlsConfig()
+	tc.ClientCert = ""
+	tc.ClientKey = ""
+	conf := api.DefaultConfig()
+	conf.Address = c.Address()
+	if err := conf.ConfigureTLS(&tc); err != nil {
+		return nil, err
+	}
+	transport, ok := conf.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("could not configure client certificate")
+	}
+	transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	}
+	lc, err := api.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	lc.ClearToken()
+
+	mount := strings.Trim(viper.GetString("store.vault.cert.mount"), "/")
+	data := map[string]interface{}{}
+	if name := viper.GetString("store.vault.cert.name"); name != "" {
+		data["name"] = name
+	}
+	resp, err := lc.Logical().Write("auth/"+mount+"/login", data)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Auth == nil {
+		return nil, errors.New("no auth info returned")
+	}
+	return resp.Auth, nil
+}
+
+func (a *certAuth) Stamp(u *user.User) (string, error) {
+	cf, err := certPaths(u)
+	if err != nil {
+		return "", err
+	}
+	return fileStamp(u, cf.CertFile, cf.KeyFile)
+}
+
+// loadClientCert loads the client certificate cf of user u. The files are read
+// once and checked like by openUserFile, so they can't be replaced by symlinks
+// after being checked.
+func loadClientCert(cf certFiles, u *user.User) (tls.Certificate, error) {
+	certPEM, err := readUserFileContent(cf.CertFile, u)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readUserFileContent(cf.KeyFile, u)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (a *certAuth) String() string {
+	return "cert"
+}
+
+// certPaths returns the client certificate of user u.
+// store.vault.cert.useroverride takes precedence over
+// store.vault.cert.groupoverride, which takes precedence over
+// store.vault.cert.certfile and store.vault.cert.keyfile. Groups are checked in
+// the order returned by the system, starting with the primary group. $HOME is
+// substituted with the user's home directory. Certificates inside of the home
+// directory are checked like by openUserFile, also if configured for a group.
+func certPaths(u *user.User) (certFiles, error) {
+	cf := certFiles{
+		CertFile: viper.GetString("store.vault.cert.certfile"),
+		KeyFile:  viper.GetString("store.vault.cert.keyfile"),
+	}
+	var useroverride, groupoverride map[string]certFiles
+	if err := viper.UnmarshalKey("store.vault.cert.useroverride", &useroverride); err != nil {
+		return cf, fmt.Errorf("could not parse store.vault.cert.useroverride: %v", err)
+	}
+	if err := viper.UnmarshalKey("store.vault.cert.groupoverride", &groupoverride); err != nil {
+		return cf, fmt.Errorf("could not parse store.vault.cert.groupoverride: %v", err)
+	}
+	if o, ok := useroverride[u.Username]; ok {
+		cf = o
+	} else if len(groupoverride) > 0 {
+		gids, err := u.GroupIds()
+		if err != nil {
+			return cf, err
+		}
+		for _, gid := range append([]string{u.Gid}, gids...) {
+			g, err := user.LookupGroupId(gid)
+			if err != nil {
+				continue
+			}
+			if o, ok := groupoverride[g.Name]; ok {
+				cf = o
+				break
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"username": u.Username,
+		"certfile": cf.CertFile,
+		"keyfile":  cf.KeyFile}).Debug("log values")
+	if cf.CertFile == "" || cf.KeyFile == "" {
+		return cf, NewError(ErrNoCredentials, fmt.Errorf("no client certificate configured for user %s", u.Username))
+	}
+	cf.CertFile = strings.Replace(cf.CertFile, "$HOME", u.HomeDir, 1)
+	cf.KeyFile = strings.Replace(cf.KeyFile, "$HOME", u.HomeDir, 1)
+	return cf, nil
+}
+
+func init() {
+	RegisterAuthMethod(&approleAuth{unwrapped: make(map[string]string)})
+	RegisterAuthMethod(&tokenAuth{})
+	RegisterAuthMethod(&passwordAuth{name: "userpass"})
+	RegisterAuthMethod(&passwordAuth{name: "ldap"})
+	RegisterAuthMethod(&jwtAuth{name: "kubernetes"})
+	RegisterAuthMethod(&jwtAuth{name: "jwt"})
+	RegisterAuthMethod(&certAuth{})
+}
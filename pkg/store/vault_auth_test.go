@@ -0,0 +1,182 @@
+package store
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestOpenUserFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretsfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	home := filepath.Join(dir, "home")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{home, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name string, perm os.FileMode) string {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte("s3cr3t\n"), perm); err != nil {
+			t.Fatal(err)
+		}
+		// not affected by the umask
+		if err := os.Chmod(f, perm); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	link := func(name, target string) string {
+		f := filepath.Join(dir, name)
+		if err := os.Symlink(target, f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	owned := write("home/.vault-token", 0600)
+	secret := write("outside/token", 0600)
+	groupWritable := write("home/.vault-group", 0620)
+	worldWritable := write("home/.vault-world", 0602)
+	linked := link("home/.vault-link", secret)
+	trusted := link("outside/link", secret)
+
+	u := &user.User{Username: "test", Uid: strconv.Itoa(os.Getuid()), HomeDir: home}
+	other := &user.User{Username: "other", Uid: strconv.Itoa(os.Getuid() + 1), HomeDir: home}
+
+	tables := []struct {
+		name  string
+		spath string
+		u     *user.User
+		err   bool
+	}{
+		{"owned file in home", owned, u, false},
+		{"file of other user in home", owned, other, true},
+		{"group writable file in home", groupWritable, u, true},
+		{"world writable file in home", worldWritable, u, true},
+		{"symlink in home", linked, u, true},
+		{"directory in home", home + "/", u, true},
+		{"file outside of home", secret, other, false},
+		{"symlink outside of home", trusted, other, false},
+		{"missing file", filepath.Join(home, "missing"), u, true},
+	}
+
+	for _, table := range tables {
+		lines, err := readUserFile(table.spath, table.u)
+		if table.err {
+			if err == nil {
+				t.Errorf("reading %s was incorrect, got: %q, want an error.", table.name, lines)
+			}
+		} else if err != nil || len(lines) != 1 || lines[0] != "s3cr3t" {
+			t.Errorf("reading %s was incorrect, got: %q, %v, want: %q.", table.name, lines, err, "s3cr3t")
+		}
+		if _, err := fileStamp(table.u, table.spath); (err != nil) != table.err {
+			t.Errorf("stamping %s was incorrect, got: %v, want an error: %v.", table.name, err, table.err)
+		}
+	}
+}
+
+func TestLoadClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretsfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	home := filepath.Join(dir, "home")
+	if err := os.Mkdir(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "host"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := filepath.Join(dir, "host.pem")
+	keyPEM := filepath.Join(dir, "host.key")
+	if err := ioutil.WriteFile(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{"cert.pem": certPEM, "key.pem": keyPEM} {
+		if err := os.Symlink(target, filepath.Join(home, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := &user.User{Username: "test", Uid: strconv.Itoa(os.Getuid() + 1), HomeDir: home}
+	tables := []struct {
+		name string
+		cf   certFiles
+		err  bool
+	}{
+		{"host certificate", certFiles{CertFile: certPEM, KeyFile: keyPEM}, false},
+		{"linked into home", certFiles{CertFile: filepath.Join(home, "cert.pem"), KeyFile: filepath.Join(home, "key.pem")}, true},
+		{"key linked into home", certFiles{CertFile: certPEM, KeyFile: filepath.Join(home, "key.pem")}, true},
+		{"key as certificate", certFiles{CertFile: keyPEM, KeyFile: keyPEM}, true},
+	}
+
+	for _, table := range tables {
+		cert, err := loadClientCert(table.cf, u)
+		if table.err {
+			if err == nil {
+				t.Errorf("loading %s was incorrect, want an error.", table.name)
+			}
+		} else if err != nil || len(cert.Certificate) != 1 {
+			t.Errorf("loading %s was incorrect, got: %v, want a certificate.", table.name, err)
+		}
+	}
+
+	// certificates of groups are checked as well when inside of the home
+	// directory, otherwise members could link the host's certificate there
+	cu, err := user.Current()
+	if err != nil {
+		t.Skip("current user unknown:", err)
+	}
+	g, err := user.LookupGroupId(cu.Gid)
+	if err != nil {
+		t.Skip("primary group unknown:", err)
+	}
+	defer viper.Set("store.vault.cert.groupoverride", nil)
+	viper.Set("store.vault.cert.groupoverride", map[string]interface{}{g.Name: map[string]interface{}{"certfile": "$HOME/cert.pem", "keyfile": "$HOME/key.pem"}})
+	member := *cu
+	member.HomeDir = home
+	cf, err := certPaths(&member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadClientCert(cf, &member); err == nil {
+		t.Errorf("loading certificate of group linked into home was incorrect, want an error.")
+	}
+}
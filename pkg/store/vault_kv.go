@@ -4,201 +4,634 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os/user"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
 	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
-	vh "github.com/muryoutaisuu/vaulthelper"
-	pfvault "github.com/postfinance/vault/kv"
 )
 
-// kv mount path
-const KVMountPath = "secret/"
+// kvMount configures a mount of Vault's KV secret engine.
+// All mounts are configured with store.vault.mounts.
+type kvMount struct {
+	// Path of the mount in Vault, e.g. "secret/"
+	Path string `mapstructure:"path"`
+	// Name of the top level directory containing the secrets of the mount
+	Name string `mapstructure:"name"`
+	// KvVersion is the version of the KV secret engine, 0 for detecting it
+	KvVersion int `mapstructure:"kvversion"`
+}
 
 type VaultKv struct {
+	mounts []*kvMount
 }
 
 var _ = (Store)((*VaultKv)(nil))
 
 func (s *VaultKv) GetSecret(spath string, ctx context.Context) (*Secret, error) {
-	return getSecret(spath, ctx, true)
+	var sec *Secret
+	err := retryInvalidSession(ctx, func() (err error) {
+		sec, err = s.getSecret(spath, ctx, true)
+		return err
+	})
+	return sec, err
+}
+
+func (s *VaultKv) PutSecret(sec *Secret, ctx context.Context) error {
+	return retryInvalidSession(ctx, func() error {
+		return s.putSecret(sec, ctx)
+	})
+}
+
+func (s *VaultKv) DeleteSecret(sec *Secret, ctx context.Context) error {
+	return retryInvalidSession(ctx, func() error {
+		return s.deleteSecret(sec, ctx)
+	})
+}
+
+// CheckWrite returns ErrPermissionDenied, if the calling user may not write
+// sec, without changing it
+func (s *VaultKv) CheckWrite(sec *Secret, ctx context.Context) error {
+	return retryInvalidSession(ctx, func() error {
+		m, mpath, c, err := s.writeClient(sec, ctx)
+		if err != nil {
+			return err
+		}
+		// keys are stored in their parent secret
+		if sfsfh.IsFile(sec.Mode) {
+			mpath = path.Dir(mpath)
+		}
+		ok, err := c.CanWrite(mpath)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return NewError(ErrPermissionDenied, fmt.Errorf("%s of mount %s may not be written", mpath, m.Path))
+		}
+		return nil
+	})
 }
 
-func getSecret(spath string, ctx context.Context, appendSubs bool) (*Secret, error) {
-	u, err := sfsfh.GetUserFromContext(ctx)
+func (s *VaultKv) GetMetadata(sec *Secret, ctx context.Context) (Metadata, error) {
+	var md Metadata
+	err := retryInvalidSession(ctx, func() (err error) {
+		md, err = s.getMetadata(sec, ctx)
+		return err
+	})
+	return md, err
+}
+
+func (s *VaultKv) PutMetadata(sec *Secret, name, value string, ctx context.Context) error {
+	return retryInvalidSession(ctx, func() error {
+		return s.updateCustomMetadata(sec, name, ctx, func(custom map[string]interface{}) error {
+			custom[strings.TrimPrefix(name, customMetadataPrefix)] = value
+			return nil
+		})
+	})
+}
+
+func (s *VaultKv) DeleteMetadata(sec *Secret, name string, ctx context.Context) error {
+	return retryInvalidSession(ctx, func() error {
+		return s.updateCustomMetadata(sec, name, ctx, func(custom map[string]interface{}) error {
+			key := strings.TrimPrefix(name, customMetadataPrefix)
+			if _, ok := custom[key]; !ok {
+				return NewError(ErrNotFound, fmt.Errorf("%s has no metadata %s", sec.Path, name))
+			}
+			delete(custom, key)
+			return nil
+		})
+	})
+}
+
+func (s *VaultKv) GetVersions(spath string, ctx context.Context) ([]int, error) {
+	var versions []int
+	err := retryInvalidSession(ctx, func() (err error) {
+		versions, err = s.getVersions(spath, ctx)
+		return err
+	})
+	return versions, err
+}
+
+func (s *VaultKv) GetSecretVersion(spath string, version int, ctx context.Context) (*Secret, error) {
+	var sec *Secret
+	err := retryInvalidSession(ctx, func() (err error) {
+		sec, err = s.getSecretVersion(spath, version, ctx)
+		return err
+	})
+	return sec, err
+}
+
+// Clients returns KvClients of the calling user for all configured mounts
+// mapped to their names
+func (s *VaultKv) Clients(ctx context.Context) (map[string]*KvClient, error) {
+	clients := make(map[string]*KvClient)
+	for _, m := range s.mounts {
+		c, err := s.kvClient(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		clients[m.Name] = c
+	}
+	return clients, nil
+}
+
+// resolve returns the mount containing spath and the path relative to that
+// mount. spath starts with either the name or the path of a mount, names take
+// precedence over paths.
+//   secret/app/db      -> mount with name "secret", "app/db"
+//   kv/team-a/app/db   -> mount with path "kv/team-a/", "app/db"
+func (s *VaultKv) resolve(spath string) (*kvMount, string, error) {
+	spath = strings.Trim(spath, "/")
+	for _, m := range s.mounts {
+		if mpath, ok := cutMountPrefix(spath, m.Name); ok {
+			return m, mpath, nil
+		}
+	}
+	for _, m := range s.mounts {
+		if mpath, ok := cutMountPrefix(spath, strings.TrimSuffix(m.Path, "/")); ok {
+			return m, mpath, nil
+		}
+	}
+	return nil, "", NewError(ErrNotFound, fmt.Errorf("%s is not located in any mount configured in store.vault.mounts", spath))
+}
+
+// canonicalPath returns spath starting with the name of its mount, so that
+// the cache shares the entries of the paths by mount name and mount path
+func (s *VaultKv) canonicalPath(spath string) string {
+	m, mpath, err := s.resolve(spath)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"spath":      spath,
-			"appendSubs": appendSubs,
-			"error":      err}).Error("got error while getting user from context")
-		return nil, err
+		return strings.Trim(spath, "/")
+	}
+	return path.Join(m.Name, mpath)
+}
+
+// cutMountPrefix returns spath without its leading mount prefix and whether
+// spath was located in prefix
+func cutMountPrefix(spath, prefix string) (string, bool) {
+	if spath == prefix {
+		return "", true
+	}
+	if strings.HasPrefix(spath, prefix+"/") {
+		return spath[len(prefix)+1:], true
 	}
+	return "", false
+}
+
+func (s *VaultKv) getSecret(spath string, ctx context.Context, appendSubs bool) (*Secret, error) {
+	// only the raw uid is logged, the user is looked up by GetClient, which
+	// doesn't need a passwd entry with store.vault.auth.serviceidentity
+	owner, _ := sfsfh.GetOwnerFromContext(ctx)
 	log.WithFields(log.Fields{
 		"spath":      spath,
 		"appendSubs": appendSubs,
-		"username":   u.Username}).Info("User accessing a secret")
-	c, err := GetClient(ctx)
+		"uid":        owner.Uid}).Info("User accessing a secret")
+
+	// the root contains all mounts
+	if strings.Trim(spath, "/") == "" {
+		root := &Secret{Path: spath, Mode: sfsfh.DIRREAD}
+		for _, m := range s.mounts {
+			root.Subs = append(root.Subs, &Secret{Path: m.Name, Mode: sfsfh.DIRREAD})
+		}
+		return root, nil
+	}
+
+	m, mpath, err := s.resolve(spath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.kvClient(ctx, m)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"spath":      spath,
-			"pfclient":   c,
+			"mount":      m.Path,
 			"appendSubs": appendSubs,
 			"error":      err}).Error("got error while getting vault client")
 		return nil, err
 	}
-	t := vh.GetTypes(c, KVMountPath+spath)
 
-	switch {
-	case t[vh.CPath], t[vh.CSecret]:
+	// mpath may be a path containing further secrets, a secret containing keys
+	// or both at the same time
+	entries, lerr := c.List(mpath)
+	data, rerr := c.Read(mpath)
+	isPath := lerr == nil && entries != nil
+	isSecret := rerr == nil && data != nil
+	log.WithFields(log.Fields{
+		"spath":    spath,
+		"mpath":    mpath,
+		"kvclient": c,
+		"isPath":   isPath,
+		"isSecret": isSecret,
+		"lerr":     lerr,
+		"rerr":     rerr}).Debug("log values")
+
+	if isPath || isSecret {
 		s := &Secret{
-			Path: spath,
-			Mode: sfsfh.DIRREAD,
-		}
-
-		// append keys as Subs, if type is CScret
-		if t[vh.CSecret] && appendSubs {
-			data, err := c.Read(KVMountPath + spath)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"spath":         spath,
-					"pfclient":      c,
-					"appendSubs":    appendSubs,
-					"t":             t,
-					"t[vh.CSecret]": t[vh.CSecret],
-					"type":          "vh.CSecret",
-					"storesecret":   s,
-					"data":          data,
-					"error":         err}).Warn("got error while getting vault secret with client and spath for adding as subs to store secret. Continuing...")
-			} else {
-				for k := range data {
-					newsec := &Secret{
-						Path: filepath.Join(spath, k),
-						Mode: sfsfh.FILEREAD,
-					}
-					s.Subs = append(s.Subs, newsec)
-				}
-			}
+			Path:    spath,
+			Mode:    sfsfh.DIRREAD,
+			HasKeys: isSecret,
 		}
-
-		// append Paths as Subs, if type is CPath
-		if t[vh.CPath] && appendSubs {
-			keys, err := c.List(KVMountPath + spath)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"spath":       spath,
-					"pfclient":    c,
-					"appendSubs":  appendSubs,
-					"t":           t,
-					"t[vh.CPath]": t[vh.CPath],
-					"type":        "vh.CPath",
-					"storesecret": s,
-					"error":       err}).Warn("got error while getting vault secret with client and spath for adding as subs to store secret. Continuing...")
-			} else {
-				for _, v := range keys {
-					newsec := &Secret{
-						Path: filepath.Join(spath, v),
-						Mode: sfsfh.DIRREAD,
-					}
-					s.Subs = append(s.Subs, newsec)
-				}
-			}
+		if !appendSubs {
+			return s, nil
+		}
+		// append keys as Subs, if it is a secret, their values were read anyway
+		values, err := keyValues(data, base64Suffix())
+		if err != nil {
+			return nil, err
+		}
+		for k, content := range values {
+			s.Subs = append(s.Subs, &Secret{
+				Path:    filepath.Join(spath, k),
+				Mode:    sfsfh.FILEREAD,
+				Content: content,
+			})
 		}
+		// append paths as Subs, if it is a path
+		s.Subs = append(s.Subs, listedSecrets(spath, entries)...)
 		return s, nil
+	}
 
-	case t[vh.CKey]:
-		content, err := vh.GetValueFromKey(c, KVMountPath+spath)
+	// the mount itself is always a path, even if it is empty
+	if mpath == "" {
+		return &Secret{Path: spath, Mode: sfsfh.DIRREAD}, nil
+	}
+
+	// mpath may be a key of its parent secret, the mount itself contains no keys
+	if pdir := path.Dir(mpath); pdir != "." {
+		parent, err := c.Read(pdir)
 		if err != nil {
 			return nil, err
 		}
-		return &Secret{
-			Path:    spath,
-			Mode:    sfsfh.FILEREAD,
-			Content: content,
-		}, nil
+		values, err := keyValues(parent, base64Suffix())
+		if err != nil {
+			return nil, err
+		}
+		if content, ok := values[path.Base(mpath)]; ok {
+			return &Secret{
+				Path:    spath,
+				Mode:    sfsfh.FILEREAD,
+				Content: content,
+			}, nil
+		}
+	}
 
-	default: // probably not enough permissions to determine type -> would probably be a directory
-		return nil, fmt.Errorf("could not evaluate filetype of %s\n", spath)
+	// probably not enough permissions to determine type
+	if lerr != nil {
+		return nil, lerr
 	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	return nil, NewError(ErrNotFound, fmt.Errorf("could not evaluate filetype of %s", spath))
 }
 
-func (s *VaultKv) String() string {
-	return "vault_kv"
+// listedSecrets returns the entries listed at spath as directories. Vault
+// lists secrets by their names and paths with a trailing slash, so a secret
+// containing further secrets is listed twice, but returned once.
+func listedSecrets(spath string, entries []string) []*Secret {
+	var subs []*Secret
+	paths := make(map[string]*Secret)
+	for _, v := range entries {
+		name := strings.TrimSuffix(v, "/")
+		sub, ok := paths[name]
+		if !ok {
+			sub = &Secret{
+				Path: filepath.Join(spath, name),
+				Mode: sfsfh.DIRREAD,
+			}
+			paths[name] = sub
+			subs = append(subs, sub)
+		}
+		if !strings.HasSuffix(v, "/") {
+			sub.HasKeys = true
+		}
+	}
+	return subs
 }
 
-// GetClient returns a postfinance vault client.
-// The context is used to detect the calling user and loading his vault
-// approleId
-func GetClient(ctx context.Context) (*pfvault.Client, error) {
-	// Get default vault client configuration
-	conf := api.DefaultConfig()
-	a := viper.GetString("store.vault.addr")
-	conf.Address = a
+// customMetadataPrefix prefixes the names of custom metadata, the only
+// metadata that can be changed
+const customMetadataPrefix = "custom_metadata."
 
-	// check TLS settings
-	if len(a) >= 5 && a[:5] == "https" {
-		if err := configureTLS(conf); err != nil {
-			log.WithFields(log.Fields{
-				"address": a,
-				"err":     err}).Fatal("got error while configuring TLS, shutting down")
+// getMetadata returns the metadata of sec, see Store.GetMetadata. Contains
+// the path of the mount and, on KV version 2, the current version and the
+// times of the secret, as well as its custom metadata.
+func (s *VaultKv) getMetadata(sec *Secret, ctx context.Context) (Metadata, error) {
+	if strings.Trim(sec.Path, "/") == "" {
+		return Metadata{}, nil
+	}
+	m, mpath, err := s.resolve(sec.Path)
+	if err != nil {
+		return nil, err
+	}
+	md := Metadata{"mount": m.Path}
+	spath := metadataSecret(sec, mpath)
+	if spath == "" {
+		return md, nil
+	}
+	c, err := s.kvClient(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.ReadMetadata(spath)
+	if err != nil || data == nil {
+		return md, err
+	}
+
+	version, _ := valueString(data["current_version"])
+	md["version"] = version
+	md["created_time"], _ = data["created_time"].(string)
+	md["updated_time"], _ = data["updated_time"].(string)
+	if versions, ok := data["versions"].(map[string]interface{}); ok {
+		if v, ok := versions[version].(map[string]interface{}); ok {
+			md["deletion_time"], _ = v["deletion_time"].(string)
+		}
+	}
+	custom, _ := data["custom_metadata"].(map[string]interface{})
+	for k, v := range custom {
+		md[customMetadataPrefix+k], _ = valueString(v)
+	}
+	return md, nil
+}
+
+// updateCustomMetadata changes the custom metadata of sec with update, name
+// is the name of the changed metadata
+func (s *VaultKv) updateCustomMetadata(sec *Secret, name string, ctx context.Context, update func(map[string]interface{}) error) error {
+	if !strings.HasPrefix(name, customMetadataPrefix) {
+		return NewError(ErrNotSupported, fmt.Errorf("metadata %s can't be changed, only custom metadata", name))
+	}
+	m, mpath, err := s.resolve(sec.Path)
+	if err != nil {
+		return err
+	}
+	spath := metadataSecret(sec, mpath)
+	if spath == "" {
+		return NewError(ErrNotSupported, fmt.Errorf("mount %s has no metadata", m.Path))
+	}
+	c, err := s.kvClient(ctx, m)
+	if err != nil {
+		return err
+	}
+	data, err := c.ReadMetadata(spath)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		if c.Version != 2 {
+			return NewError(ErrNotSupported, fmt.Errorf("mount %s of KV version %d keeps no metadata", m.Path, c.Version))
 		}
+		return NewError(ErrNotFound, fmt.Errorf("%s is no secret", sec.Path))
+	}
+	custom, _ := data["custom_metadata"].(map[string]interface{})
+	if custom == nil {
+		custom = make(map[string]interface{})
+	}
+	if err := update(custom); err != nil {
+		return err
 	}
+	log.WithFields(log.Fields{"spath": sec.Path, "mount": m.Path, "secret": spath, "name": name}).Info("changing custom metadata of secret")
+	return c.WriteCustomMetadata(spath, custom)
+}
 
-	// Create new vault client with vault configuration
-	vc, err := api.NewClient(conf) // VaultClient
+// metadataSecret returns the path of the secret holding the metadata of sec
+// relative to its mount at mpath, "" for the mount itself. Keys have the
+// metadata of their secret.
+func metadataSecret(sec *Secret, mpath string) string {
+	if sfsfh.IsFile(sec.Mode) {
+		mpath = path.Dir(mpath)
+	}
+	if mpath == "." {
+		return ""
+	}
+	return mpath
+}
+
+// getVersions returns the versions of secret spath, see Store.GetVersions.
+// Mounts of KV version 1 keep no versions.
+func (s *VaultKv) getVersions(spath string, ctx context.Context) ([]int, error) {
+	if strings.Trim(spath, "/") == "" {
+		return nil, nil
+	}
+	m, mpath, err := s.resolve(spath)
+	if err != nil || mpath == "" {
+		return nil, err
+	}
+	c, err := s.kvClient(ctx, m)
 	if err != nil {
 		return nil, err
 	}
-	// Get user doing the filesystem request
-	u, err := sfsfh.GetUserFromContext(ctx)
+	data, err := c.ReadMetadata(mpath)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return retainedVersions(data, time.Now()), nil
+}
+
+// getSecretVersion returns version of secret spath, see
+// Store.GetSecretVersion
+func (s *VaultKv) getSecretVersion(spath string, version int, ctx context.Context) (*Secret, error) {
+	m, mpath, err := s.resolve(spath)
 	if err != nil {
 		return nil, err
 	}
-	// Read approleId from configfile
-	approleId, err := getApproleId(u)
+	if mpath == "" {
+		return nil, NewError(ErrNotFound, fmt.Errorf("mount %s has no versions", m.Path))
+	}
+	c, err := s.kvClient(ctx, m)
 	if err != nil {
 		return nil, err
 	}
-	// Login with approleId, get accessToken
-	accessToken, err := VaultApproleLogin(vc, approleId)
+	log.WithFields(log.Fields{"spath": spath, "version": version}).Info("User accessing a secret version")
+	data, err := c.ReadVersion(mpath, version)
 	if err != nil {
 		return nil, err
 	}
-	// Set accessToken and return pfvault Client
-	vc.SetToken(accessToken)
-	// Create new pfvault client with vault client
-	pfc, err := pfvault.New(vc, KVMountPath) //PostFinanceClient
+	if data == nil {
+		return nil, NewError(ErrNotFound, fmt.Errorf("version %d of %s does not exist", version, spath))
+	}
+	values, err := keyValues(data, base64Suffix())
+	if err != nil {
+		return nil, err
+	}
+	sec := &Secret{Path: spath, Mode: sfsfh.DIRREAD}
+	for k, content := range values {
+		sec.Subs = append(sec.Subs, &Secret{
+			Path:    filepath.Join(spath, k),
+			Mode:    sfsfh.FILEREAD,
+			Content: content,
+		})
+	}
+	return sec, nil
+}
+
+// putSecret writes the key or creates the empty secret sec, see
+// Store.PutSecret
+func (s *VaultKv) putSecret(sec *Secret, ctx context.Context) error {
+	m, mpath, c, err := s.writeClient(sec, ctx)
+	if err != nil {
+		return err
+	}
+
+	if sfsfh.IsDir(sec.Mode) {
+		data, err := c.Read(mpath)
+		if err != nil {
+			return err
+		}
+		entries, err := c.List(mpath)
+		if err != nil {
+			return err
+		}
+		if data != nil || entries != nil {
+			return NewError(ErrExists, fmt.Errorf("%s already exists", sec.Path))
+		}
+		log.WithFields(log.Fields{"spath": sec.Path, "mount": m.Path, "mpath": mpath}).Info("creating empty secret")
+		return c.Write(mpath, map[string]interface{}{})
+	}
+
+	// keys are stored in their parent secret
+	pdir, key := path.Dir(mpath), path.Base(mpath)
+	return updateSecret(c, pdir, func(data map[string]interface{}) error {
+		stored, value := encodeKey(data, key, sec.Content, base64Suffix())
+		data[stored] = value
+		log.WithFields(log.Fields{"spath": sec.Path, "mount": m.Path, "secret": pdir, "key": stored}).Info("writing key of secret")
+		return nil
+	})
+}
+
+// deleteSecret removes the key or the empty secret sec, see
+// Store.DeleteSecret
+func (s *VaultKv) deleteSecret(sec *Secret, ctx context.Context) error {
+	m, mpath, c, err := s.writeClient(sec, ctx)
+	if err != nil {
+		return err
+	}
+
+	if sfsfh.IsDir(sec.Mode) {
+		data, err := c.Read(mpath)
+		if err != nil {
+			return err
+		}
+		entries, err := c.List(mpath)
+		if err != nil {
+			return err
+		}
+		if data == nil && entries == nil {
+			return NewError(ErrNotFound, fmt.Errorf("%s does not exist", sec.Path))
+		}
+		if len(data) > 0 || len(entries) > 0 {
+			return NewError(ErrNotEmpty, fmt.Errorf("%s still contains keys or secrets", sec.Path))
+		}
+		log.WithFields(log.Fields{"spath": sec.Path, "mount": m.Path, "mpath": mpath}).Info("deleting secret")
+		return c.Delete(mpath)
+	}
+
+	// the secret is kept even if its last key is removed, so that it is still
+	// displayed as empty directory
+	pdir, key := path.Dir(mpath), path.Base(mpath)
+	return updateSecret(c, pdir, func(data map[string]interface{}) error {
+		stored, ok := storedKey(data, key, base64Suffix())
+		if !ok {
+			return NewError(ErrNotFound, fmt.Errorf("%s does not exist", sec.Path))
+		}
+		delete(data, stored)
+		log.WithFields(log.Fields{"spath": sec.Path, "mount": m.Path, "secret": pdir, "key": stored}).Info("deleting key of secret")
+		return nil
+	})
+}
+
+// maxCasRetries limits how often a secret changed concurrently is read and
+// updated again
+const maxCasRetries = 10
+
+// updateSecret reads the secret spath, changes its keys with update and writes
+// it back. On KV version 2 the secret is only written if it wasn't changed
+// since it was read, otherwise it is read and updated again, so that keys
+// written concurrently aren't lost. KV version 1 has no check-and-set, so
+// concurrent writers of keys of the same secret may overwrite each other.
+func updateSecret(c *KvClient, spath string, update func(data map[string]interface{}) error) error {
+	for i := 0; ; i++ {
+		data, version, err := c.ReadForWrite(spath)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			data = make(map[string]interface{})
+		}
+		if err := update(data); err != nil {
+			return err
+		}
+		err = c.WriteCas(spath, data, version)
+		if !errors.Is(err, errCasMismatch) || i == maxCasRetries {
+			return err
+		}
+		log.WithFields(log.Fields{"secret": spath, "version": version, "error": err}).Debug("secret was changed concurrently, updating it again")
+	}
+}
+
+// writeClient resolves the path of sec, which is written or deleted, and
+// returns its mount, the path relative to the mount and a KvClient of the
+// calling user. Mounts themselves and keys directly inside of a mount can't be
+// written, as the mount is no secret.
+func (s *VaultKv) writeClient(sec *Secret, ctx context.Context) (*kvMount, string, *KvClient, error) {
+	// the top level directories are the mounts
+	if !strings.Contains(strings.Trim(sec.Path, "/"), "/") {
+		return nil, "", nil, NewError(ErrNotSupported, errors.New("mounts can't be created or deleted"))
+	}
+	m, mpath, err := s.resolve(sec.Path)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if mpath == "" {
+		return nil, "", nil, NewError(ErrNotSupported, fmt.Errorf("mount %s can't be created or deleted", m.Path))
+	}
+	if sfsfh.IsFile(sec.Mode) && path.Dir(mpath) == "." {
+		return nil, "", nil, NewError(ErrNotSupported, fmt.Errorf("keys can only be written into secrets, not directly into mount %s", m.Path))
+	}
+	c, err := s.kvClient(ctx, m)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return m, mpath, c, nil
+}
+
+func (s *VaultKv) String() string {
+	return "vault_kv"
+}
+
+// kvClient returns a KvClient of the calling user for mount m
+func (s *VaultKv) kvClient(ctx context.Context, m *kvMount) (*KvClient, error) {
+	vc, err := GetClient(ctx)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"clientconf":    conf,
-			"user":          u,
-			"pfvaultclient": pfc,
-			"error":         err}).Error("got error while creating new pfc")
 		return nil, err
 	}
-	if pfc == nil {
+	kvc, err := NewKvClient(vc, m.Path, m.KvVersion)
+	if err != nil {
 		log.WithFields(log.Fields{
-			"clientconf":    conf,
-			"user":          u,
-			"pfvaultclient": pfc,
-			"KVMountPath":   KVMountPath,
-			"error":         err}).Error("pfc is unexpectedly nil, probably not enough permissions to list KVMountPath")
-		return nil, fmt.Errorf("msg=\"pfc is unexpectedly nil, probably not enough permissions to list '%v' on vault server\"\n", KVMountPath)
+			"mount": m.Path,
+			"error": err}).Error("got error while creating new KvClient, probably not enough permissions to access mount")
+		return nil, err
 	}
 	log.WithFields(log.Fields{
-		"clientconf":    conf,
-		"user":          u,
-		"pfvaultclient": pfc,
-		"KVMountPath":   KVMountPath}).Debug("log values")
-	return pfc, err
+		"mount":    m.Path,
+		"kvclient": kvc}).Debug("log values")
+	return kvc, nil
 }
 
 func configureTLS(c *api.Config) error {
+	tls := tlsConfig()
+	err := c.ConfigureTLS(&tls)
+	if c.Error != nil {
+		return c.Error
+	}
+	return err
+}
+
+// tlsConfig returns the TLS settings configured in store.vault.tls
+func tlsConfig() api.TLSConfig {
 	tls := api.TLSConfig{}
 	if viper.IsSet("store.vault.tls.cacert") {
 		tls.CACert = viper.GetString("store.vault.tls.cacert")
@@ -218,57 +651,51 @@ func configureTLS(c *api.Config) error {
 	if viper.IsSet("store.vault.tls.insecure") {
 		tls.Insecure = viper.GetBool("store.vault.tls.insecure")
 	}
-	err := c.ConfigureTLS(&tls)
-	if c.Error != nil {
-		return c.Error
-	}
-	return err
+	return tls
 }
 
-func getApproleId(u *user.User) (authToken string, err error) {
-	spath := FinIdPath(u)
-	log.WithFields(log.Fields{
-		"username": u.Username,
-		"spath":    spath}).Debug("log values")
-	o, err := ioutil.ReadFile(spath)
+// newVaultKv is the Factory of the vault_kv store
+func newVaultKv() (Store, error) {
+	mounts, err := loadMounts()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"username": u.Username,
-			"spath":    spath,
-			"error":    err}).Error("could not read spath for getting approleId")
-		return "", err
-	}
-	return strings.TrimSuffix(string(o), "\n"), nil
-}
-
-func FinIdPath(u *user.User) (spath string) {
-	spath = viper.GetString("store.vault.roleid.file")
-	overriddenusers := viper.GetStringMapString("store.vault.roleid.useroverride")
-	log.WithFields(log.Fields{
-		"user":           u,
-		"username":       u.Name,
-		"overridenusers": overriddenusers}).Debug("log values")
-	if newpath, ok := overriddenusers[u.Username]; ok {
-		spath = newpath
+		return nil, err
 	}
-	return strings.Replace(spath, "$HOME", u.HomeDir, 1)
+	return &VaultKv{mounts: mounts}, nil
 }
 
-func VaultApproleLogin(c *api.Client, approleId string) (accessToken string, err error) {
-	data := map[string]interface{}{
-		"role_id": approleId,
+// loadMounts reads and validates store.vault.mounts
+func loadMounts() ([]*kvMount, error) {
+	var mounts []*kvMount
+	if err := viper.UnmarshalKey("store.vault.mounts", &mounts); err != nil {
+		return nil, fmt.Errorf("could not parse store.vault.mounts: %v", err)
 	}
-	resp, err := c.Logical().Write("auth/approle/login", data)
-	if err != nil {
-		return "", err
+	if len(mounts) == 0 {
+		return nil, errors.New("no mounts configured in store.vault.mounts")
 	}
-	if resp.Auth == nil {
-		return "", errors.New("no auth info returned")
+	names := make(map[string]bool)
+	for _, m := range mounts {
+		p := strings.Trim(m.Path, "/")
+		if p == "" {
+			return nil, errors.New("mount without path configured in store.vault.mounts")
+		}
+		m.Path = p + "/"
+		if m.Name == "" {
+			m.Name = strings.ReplaceAll(p, "/", "_")
+		}
+		if strings.Contains(m.Name, "/") {
+			return nil, fmt.Errorf("name %q of mount %s must not contain '/'", m.Name, m.Path)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("name %q is used by more than one mount in store.vault.mounts", m.Name)
+		}
+		names[m.Name] = true
+		if m.KvVersion < 0 || m.KvVersion > 2 {
+			return nil, fmt.Errorf("kvversion %d of mount %s is invalid, must be 1, 2 or 0 for detecting it", m.KvVersion, m.Path)
+		}
 	}
-	return resp.Auth.ClientToken, nil
+	return mounts, nil
 }
 
 func init() {
-	v := VaultKv{}
-	RegisterStore(&v)
+	RegisterStore("vault_kv", newVaultKv)
 }
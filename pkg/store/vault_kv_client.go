@@ -0,0 +1,431 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// KvClient reads secrets of a single mount of Vault's KV secret engine.
+// Both versions 1 and 2 of the engine are supported, paths given to KvClient
+// are always relative to the mount and free of any version specific prefixes
+// like 'data/' or 'metadata/'.
+type KvClient struct {
+	client  *api.Client
+	Mount   string // path of the mount, e.g. "secret/"
+	Version int    // version of the KV secret engine
+}
+
+// kvVersions caches the detected KV versions mapped to their mount paths
+var kvVersions = make(map[string]int)
+var kvVersionsMu sync.Mutex
+
+// NewKvClient returns a KvClient for mount using the vault client c.
+// If version is 0, the version of the KV secret engine is detected
+// automatically.
+func NewKvClient(c *api.Client, mount string, version int) (*KvClient, error) {
+	if !strings.HasSuffix(mount, "/") {
+		mount = mount + "/"
+	}
+	if version == 0 {
+		v, err := kvVersion(c, mount)
+		if err != nil {
+			return nil, err
+		}
+		version = v
+	}
+	return &KvClient{client: c, Mount: mount, Version: version}, nil
+}
+
+// kvVersion returns the KV version of mount, detecting it if it isn't known yet
+func kvVersion(c *api.Client, mount string) (int, error) {
+	kvVersionsMu.Lock()
+	defer kvVersionsMu.Unlock()
+	if v, ok := kvVersions[mount]; ok {
+		return v, nil
+	}
+	v, err := detectKvVersion(c, mount)
+	if err != nil {
+		return 0, err
+	}
+	log.WithFields(log.Fields{"mount": mount, "version": v}).Info("detected KV secret engine version")
+	kvVersions[mount] = v
+	return v, nil
+}
+
+// detectKvVersion asks Vault for the KV version of mount.
+// sys/internal/ui/mounts is tried first, as it is accessible for every token
+// with any capability on the mount. Older Vault versions only know
+// sys/mounts, which needs read capabilities on sys/mounts.
+func detectKvVersion(c *api.Client, mount string) (int, error) {
+	s, err := c.Logical().Read("sys/internal/ui/mounts/" + mount)
+	if err == nil && s != nil && s.Data != nil {
+		t, _ := s.Data["type"].(string)
+		var options map[string]interface{}
+		if o, ok := s.Data["options"].(map[string]interface{}); ok {
+			options = o
+		}
+		version, _ := options["version"].(string)
+		return parseKvVersion(mount, t, version)
+	}
+	log.WithFields(log.Fields{"mount": mount, "error": err}).Debug("could not read sys/internal/ui/mounts, falling back to sys/mounts")
+
+	mounts, err := c.Sys().ListMounts()
+	if err != nil {
+		return 0, fmt.Errorf("could not detect KV version of mount %s: %w", mount, err)
+	}
+	m, ok := mounts[mount]
+	if !ok {
+		return 0, NewError(ErrNotFound, fmt.Errorf("mount %s does not exist", mount))
+	}
+	return parseKvVersion(mount, m.Type, m.Options["version"])
+}
+
+// parseKvVersion returns the KV version of a mount of type t with the
+// version option
+func parseKvVersion(mount, t, version string) (int, error) {
+	switch t {
+	case "kv":
+		// KV mounts without version option are version 1
+		if version == "" {
+			return 1, nil
+		}
+		return strconv.Atoi(version)
+	case "generic":
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("mount %s is not of type kv but %q", mount, t)
+	}
+}
+
+// dataPath returns the API path for reading and writing secret spath
+func (k *KvClient) dataPath(spath string) string {
+	if k.Version == 2 {
+		return k.Mount + "data/" + spath
+	}
+	return k.Mount + spath
+}
+
+// metadataPath returns the API path for listing spath and reading the
+// metadata of secret spath
+func (k *KvClient) metadataPath(spath string) string {
+	if k.Version == 2 {
+		return k.Mount + "metadata/" + spath
+	}
+	return k.Mount + spath
+}
+
+// Read returns the key value pairs of secret spath.
+// Returns nil without error if the secret does not exist or its latest
+// version was deleted or destroyed.
+func (k *KvClient) Read(spath string) (map[string]interface{}, error) {
+	s, err := k.client.Logical().Read(k.dataPath(spath))
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.Data == nil {
+		return nil, nil
+	}
+	if k.Version == 2 {
+		data, _ := s.Data["data"].(map[string]interface{})
+		return data, nil
+	}
+	return s.Data, nil
+}
+
+// ReadForWrite returns the key value pairs of secret spath like Read, and the
+// version they belong to, which is passed to WriteCas. The version is 0 if the
+// secret does not exist and always on KV version 1.
+func (k *KvClient) ReadForWrite(spath string) (map[string]interface{}, int, error) {
+	if k.Version != 2 {
+		data, err := k.Read(spath)
+		return data, 0, err
+	}
+	s, err := k.client.Logical().Read(k.dataPath(spath))
+	if err != nil {
+		return nil, 0, err
+	}
+	if s == nil || s.Data == nil {
+		return nil, 0, nil
+	}
+	// the metadata is returned as well, if the latest version was deleted
+	data, _ := s.Data["data"].(map[string]interface{})
+	md, _ := s.Data["metadata"].(map[string]interface{})
+	version, err := intValue(md["version"])
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not parse version of secret %s: %v", spath, err)
+	}
+	return data, version, nil
+}
+
+// intValue returns the integer v of a response
+func intValue(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return strconv.Atoi(n.String())
+	case float64:
+		return int(n), nil
+	}
+	return 0, fmt.Errorf("%v is no number", v)
+}
+
+// List returns the entries of path spath, subpaths end with a '/'.
+// Returns nil without error if there are no entries.
+func (k *KvClient) List(spath string) ([]string, error) {
+	s, err := k.client.Logical().List(k.metadataPath(spath))
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.Data == nil {
+		return nil, nil
+	}
+	entries, _ := s.Data["keys"].([]interface{})
+	keys := make([]string, 0, len(entries))
+	for _, v := range entries {
+		if key, ok := v.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Write replaces the key value pairs of secret spath with data
+func (k *KvClient) Write(spath string, data map[string]interface{}) error {
+	if k.Version == 2 {
+		_, err := k.client.Logical().Write(k.dataPath(spath), map[string]interface{}{"data": data})
+		return err
+	}
+	_, err := k.client.Logical().Write(k.dataPath(spath), data)
+	return err
+}
+
+// CanWrite returns whether the token of the client may write secret spath,
+// according to the policies of the token
+func (k *KvClient) CanWrite(spath string) (bool, error) {
+	caps, err := k.client.Sys().CapabilitiesSelf(k.dataPath(spath))
+	if err != nil {
+		return false, err
+	}
+	for _, c := range caps {
+		if c == "root" || c == "create" || c == "update" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// errCasMismatch is returned by WriteCas, if the secret was changed since it
+// was read
+var errCasMismatch = errors.New("secret was changed concurrently")
+
+// WriteCas replaces the key value pairs of secret spath with data, if the
+// current version of the secret is still version as returned by ReadForWrite.
+// Otherwise errCasMismatch is returned. KV version 1 has no check-and-set, so
+// the secret is always replaced.
+func (k *KvClient) WriteCas(spath string, data map[string]interface{}, version int) error {
+	if k.Version != 2 {
+		return k.Write(spath, data)
+	}
+	_, err := k.client.Logical().Write(k.dataPath(spath), map[string]interface{}{
+		"data":    data,
+		"options": map[string]interface{}{"cas": version},
+	})
+	var re *api.ResponseError
+	if errors.As(err, &re) && re.StatusCode == http.StatusBadRequest && strings.Contains(strings.Join(re.Errors, " "), "check-and-set") {
+		return fmt.Errorf("%w: %v", errCasMismatch, err)
+	}
+	return err
+}
+
+// Delete deletes secret spath. On KV version 2 all versions and the metadata
+// of the secret are deleted, so that it isn't listed anymore.
+func (k *KvClient) Delete(spath string) error {
+	_, err := k.client.Logical().Delete(k.metadataPath(spath))
+	return err
+}
+
+// ReadMetadata returns the metadata of secret spath.
+// Returns nil without error if the secret does not exist. KV version 1 keeps
+// no metadata, so nil is returned as well.
+func (k *KvClient) ReadMetadata(spath string) (map[string]interface{}, error) {
+	if k.Version != 2 {
+		return nil, nil
+	}
+	s, err := k.client.Logical().Read(k.metadataPath(spath))
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, nil
+	}
+	return s.Data, nil
+}
+
+// ReadVersion returns the key value pairs of version of secret spath.
+// Returns nil without error if the version does not exist or was deleted or
+// destroyed. Only supported by KV version 2.
+func (k *KvClient) ReadVersion(spath string, version int) (map[string]interface{}, error) {
+	if k.Version != 2 {
+		return nil, NewError(ErrNotSupported, fmt.Errorf("mount %s of KV version %d keeps no versions", k.Mount, k.Version))
+	}
+	s, err := k.client.Logical().ReadWithData(k.dataPath(spath), map[string][]string{"version": {strconv.Itoa(version)}})
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.Data == nil {
+		return nil, nil
+	}
+	data, _ := s.Data["data"].(map[string]interface{})
+	return data, nil
+}
+
+// WriteCustomMetadata replaces the custom metadata of secret spath with md.
+// Only supported by KV version 2.
+func (k *KvClient) WriteCustomMetadata(spath string, md map[string]interface{}) error {
+	if k.Version != 2 {
+		return NewError(ErrNotSupported, fmt.Errorf("mount %s of KV version %d keeps no metadata", k.Mount, k.Version))
+	}
+	_, err := k.client.Logical().Write(k.metadataPath(spath), map[string]interface{}{"custom_metadata": md})
+	return err
+}
+
+// retainedVersions returns the versions listed in the metadata md of a
+// secret, which are neither deleted nor destroyed at now, in ascending order
+func retainedVersions(md map[string]interface{}, now time.Time) []int {
+	versions, _ := md["versions"].(map[string]interface{})
+	retained := make([]int, 0, len(versions))
+	for k, v := range versions {
+		version, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		vmd, _ := v.(map[string]interface{})
+		if destroyed, _ := vmd["destroyed"].(bool); destroyed {
+			continue
+		}
+		// versions may be deleted in the future with delete_version_after
+		if dt, _ := vmd["deletion_time"].(string); dt != "" {
+			t, err := time.Parse(time.RFC3339Nano, dt)
+			if err == nil && !t.After(now) {
+				continue
+			}
+		}
+		retained = append(retained, version)
+	}
+	sort.Ints(retained)
+	return retained
+}
+
+// base64Suffix returns the suffix of keys with base64 encoded values,
+// configured with store.vault.base64suffix
+func base64Suffix() string {
+	return viper.GetString("store.vault.base64suffix")
+}
+
+// keyValues returns the values of the keys in data mapped to the names they
+// are displayed with. Values of keys ending with suffix are base64 decoded
+// and displayed without the suffix, unless another key has that name, the
+// name would be empty or the value isn't valid base64.
+func keyValues(data map[string]interface{}, suffix string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(data))
+	for k, v := range data {
+		value, err := valueString(v)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(k, suffix)
+		if suffix == "" || name == k || name == "" {
+			values[k] = []byte(value)
+			continue
+		}
+		if _, ok := data[name]; ok {
+			values[k] = []byte(value)
+			continue
+		}
+		decoded, err := decodeBase64(value)
+		if err != nil {
+			log.WithFields(log.Fields{"key": k, "error": err}).Warn("value of key is not base64 encoded, displaying it as is")
+			values[k] = []byte(value)
+			continue
+		}
+		values[name] = decoded
+	}
+	return values, nil
+}
+
+// decodeBase64 decodes s with or without padding, whitespace like line breaks
+// is ignored
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if strings.HasSuffix(s, "=") || len(s)%4 == 0 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// storedKey returns the key in data, which is displayed as name by
+// keyValues, and whether it exists
+func storedKey(data map[string]interface{}, name, suffix string) (string, bool) {
+	if _, ok := data[name]; ok {
+		return name, true
+	}
+	if suffix == "" {
+		return "", false
+	}
+	v, ok := data[name+suffix]
+	if !ok {
+		return "", false
+	}
+	if value, err := valueString(v); err != nil {
+		return "", false
+	} else if _, err := decodeBase64(value); err != nil {
+		return "", false
+	}
+	return name + suffix, true
+}
+
+// encodeKey returns the key in data content of the key displayed as name is
+// written to and the value to write. Keys stored base64 encoded stay encoded,
+// binary content, which can't be stored as string, is encoded as well and
+// replaces a plain key of that name.
+func encodeKey(data map[string]interface{}, name string, content []byte, suffix string) (string, string) {
+	stored, ok := storedKey(data, name, suffix)
+	if !ok {
+		stored = name
+	}
+	if suffix == "" || stored == name && utf8.Valid(content) {
+		return stored, string(content)
+	}
+	delete(data, name)
+	return name + suffix, base64.StdEncoding.EncodeToString(content)
+}
+
+// valueString returns the value of a key as it is displayed in a file.
+// KV version 2 stores JSON documents, so values may be of any JSON type, those
+// are returned in their JSON representation.
+func valueString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case nil:
+		return "", nil
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
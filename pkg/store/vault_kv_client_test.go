@@ -0,0 +1,292 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestRetainedVersions(t *testing.T) {
+	now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	md := map[string]interface{}{
+		"versions": map[string]interface{}{
+			"1":  map[string]interface{}{"deletion_time": "", "destroyed": true},
+			"2":  map[string]interface{}{"deletion_time": "2020-10-01T12:00:00.000000000Z", "destroyed": false},
+			"3":  map[string]interface{}{"deletion_time": "", "destroyed": false},
+			"4":  map[string]interface{}{"deletion_time": "2020-12-01T12:00:00.000000000Z", "destroyed": false},
+			"10": map[string]interface{}{"deletion_time": "", "destroyed": false},
+		},
+	}
+	tables := []struct {
+		md   map[string]interface{}
+		want []int
+	}{
+		{md, []int{3, 4, 10}},
+		{map[string]interface{}{}, []int{}},
+	}
+
+	for _, table := range tables {
+		got := retainedVersions(table.md, now)
+		if !reflect.DeepEqual(got, table.want) {
+			t.Errorf("retained versions were incorrect, got: '%v', want: '%v'\n", got, table.want)
+		}
+	}
+}
+
+func TestKeyValues(t *testing.T) {
+	data := map[string]interface{}{
+		"password":    "pw",
+		"keytab.b64":  "AAEC/w==",
+		"wrapped.b64": "AAEC\n/w",
+		"invalid.b64": "not base64!",
+		"cert":        "plain",
+		"cert.b64":    "AAEC/w==",
+		"port":        json.Number("5432"),
+		".b64":        "AAEC/w==",
+	}
+	tables := []struct {
+		suffix string
+		want   map[string]string
+	}{
+		{".b64", map[string]string{
+			"password":    "pw",
+			"keytab":      "\x00\x01\x02\xff",
+			"wrapped":     "\x00\x01\x02\xff",
+			"invalid.b64": "not base64!",
+			"cert":        "plain",
+			"cert.b64":    "AAEC/w==",
+			"port":        "5432",
+			".b64":        "AAEC/w==",
+		}},
+		{"", map[string]string{
+			"password":    "pw",
+			"keytab.b64":  "AAEC/w==",
+			"wrapped.b64": "AAEC\n/w",
+			"invalid.b64": "not base64!",
+			"cert":        "plain",
+			"cert.b64":    "AAEC/w==",
+			"port":        "5432",
+			".b64":        "AAEC/w==",
+		}},
+	}
+
+	for _, table := range tables {
+		values, err := keyValues(data, table.suffix)
+		if err != nil {
+			t.Errorf("values with suffix '%v' returned an error: %v\n", table.suffix, err)
+			continue
+		}
+		got := make(map[string]string)
+		for k, v := range values {
+			got[k] = string(v)
+		}
+		if !reflect.DeepEqual(got, table.want) {
+			t.Errorf("values with suffix '%v' were incorrect, got: '%q', want: '%q'\n", table.suffix, got, table.want)
+		}
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	tables := []struct {
+		data    map[string]interface{}
+		name    string
+		content string
+		stored  string
+		value   string
+	}{
+		{map[string]interface{}{}, "password", "pw", "password", "pw"},
+		{map[string]interface{}{"keytab.b64": "AA=="}, "keytab", "\x00\x01", "keytab.b64", "AAE="},
+		{map[string]interface{}{"keytab.b64": "AA=="}, "keytab.b64", "AAE=", "keytab.b64", "AAE="},
+		{map[string]interface{}{"keystore": "text"}, "keystore", "\xff", "keystore.b64", "/w=="},
+		{map[string]interface{}{"invalid.b64": "!"}, "invalid", "text", "invalid", "text"},
+	}
+
+	for _, table := range tables {
+		stored, value := encodeKey(table.data, table.name, []byte(table.content), ".b64")
+		if stored != table.stored || value != table.value {
+			t.Errorf("encoding '%v' was incorrect, got: '%v', '%v', want: '%v', '%v'\n", table.name, stored, value, table.stored, table.value)
+		}
+		if _, ok := table.data[table.name]; ok && stored != table.name {
+			t.Errorf("encoding '%v' kept the plain key\n", table.name)
+		}
+	}
+}
+
+// kvServer is the KV version 2 mount secret/ of a fake vault, supporting
+// check-and-set
+type kvServer struct {
+	mu       sync.Mutex
+	versions map[string][]map[string]interface{}
+	// called before a write is checked, e.g. to write concurrently
+	beforeWrite func(spath string)
+	// capabilities of the token mapped to API paths, "deny" if missing
+	capabilities map[string][]string
+}
+
+func (s *kvServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	spath := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	if r.URL.Path == "/v1/sys/capabilities-self" {
+		var body struct{ Path string }
+		json.NewDecoder(r.Body).Decode(&body)
+		caps, ok := s.capabilities[body.Path]
+		if !ok {
+			caps = []string{"deny"}
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"capabilities": caps}})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		versions := s.versions[spath]
+		s.mu.Unlock()
+		if len(versions) == 0 {
+			reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data":     versions[len(versions)-1],
+			"metadata": map[string]interface{}{"version": len(versions)},
+		}})
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Data    map[string]interface{}
+			Options map[string]interface{}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			reply(http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		if s.beforeWrite != nil {
+			s.beforeWrite(spath)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if cas, ok := body.Options["cas"].(float64); ok && int(cas) != len(s.versions[spath]) {
+			reply(http.StatusBadRequest, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		s.versions[spath] = append(s.versions[spath], body.Data)
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"version": len(s.versions[spath])}})
+	}
+}
+
+// write stores a new version of secret spath
+func (s *kvServer) write(spath string, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[spath] = append(s.versions[spath], data)
+}
+
+// newKvServerClient returns a KvClient of the mount secret/ of s
+func newKvServerClient(t *testing.T, s *kvServer) (*KvClient, func()) {
+	srv := httptest.NewServer(s)
+	c, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	c.SetToken("token")
+	return &KvClient{client: c, Mount: "secret/", Version: 2}, srv.Close
+}
+
+func TestUpdateSecret(t *testing.T) {
+	tables := []struct {
+		name       string
+		concurrent int // writes of other keys before writing
+		key        string
+		want       map[string]interface{}
+		versions   int
+		err        error
+	}{
+		{"write", 0, "password", map[string]interface{}{"port": "5432", "password": "v"}, 2, nil},
+		{"write concurrently", 1, "password", map[string]interface{}{"port": "5432", "other0": "x", "password": "v"}, 3, nil},
+		{"write concurrently twice", 2, "password", map[string]interface{}{"port": "5432", "other0": "x", "other1": "x", "password": "v"}, 4, nil},
+		{"write always concurrently", 100, "password", nil, 0, errCasMismatch},
+		{"delete", 0, "", map[string]interface{}{}, 2, nil},
+		{"delete concurrently", 1, "", map[string]interface{}{"other0": "x"}, 3, nil},
+	}
+
+	for _, table := range tables {
+		s := &kvServer{versions: map[string][]map[string]interface{}{
+			"app/db": {{"port": "5432"}},
+		}}
+		writes := 0
+		s.beforeWrite = func(spath string) {
+			if writes < table.concurrent {
+				s.mu.Lock()
+				latest := s.versions[spath][len(s.versions[spath])-1]
+				data := map[string]interface{}{"other" + strconv.Itoa(writes): "x"}
+				for k, v := range latest {
+					data[k] = v
+				}
+				s.mu.Unlock()
+				s.write(spath, data)
+				writes++
+			}
+		}
+		c, done := newKvServerClient(t, s)
+		err := updateSecret(c, "app/db", func(data map[string]interface{}) error {
+			if table.key == "" {
+				delete(data, "port")
+			} else {
+				data[table.key] = "v"
+			}
+			return nil
+		})
+		done()
+		if table.err != nil {
+			if !errors.Is(err, table.err) {
+				t.Errorf("updating secret %s was incorrect, got: %v, want: %v.", table.name, err, table.err)
+			}
+			continue
+		}
+		versions := s.versions["app/db"]
+		if err != nil || len(versions) != table.versions || !reflect.DeepEqual(versions[len(versions)-1], table.want) {
+			t.Errorf("updating secret %s was incorrect, got: %v, %d versions, %v, want: %v, %d versions.", table.name, err, len(versions), versions[len(versions)-1], table.want, table.versions)
+		}
+	}
+}
+
+func TestCanWrite(t *testing.T) {
+	s := &kvServer{capabilities: map[string][]string{
+		"secret/data/app/db":    {"read", "update"},
+		"secret/data/app/new":   {"create"},
+		"secret/data/app/ro":    {"read", "list"},
+		"secret/data/admin/all": {"root"},
+	}}
+	c, done := newKvServerClient(t, s)
+	defer done()
+
+	tables := []struct {
+		spath string
+		ok    bool
+	}{
+		{"app/db", true},
+		{"app/new", true},
+		{"app/ro", false},
+		{"admin/all", true},
+		{"app/unknown", false},
+	}
+
+	for _, table := range tables {
+		ok, err := c.CanWrite(table.spath)
+		if err != nil || ok != table.ok {
+			t.Errorf("checking write permissions of %s was incorrect, got: %t, %v, want: %t.", table.spath, ok, err, table.ok)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+)
+
+func TestResolve(t *testing.T) {
+	s := &VaultKv{
+		mounts: []*kvMount{
+			{Path: "secret/", Name: "secret"},
+			{Path: "kv/team-a/", Name: "team-a"},
+			{Path: "team-a/", Name: "legacy"},
+		},
+	}
+	tables := []struct {
+		spath     string
+		mount     string
+		mpath     string
+		canonical string
+	}{
+		{"secret", "secret/", "", "secret"},
+		{"secret/app/db/password", "secret/", "app/db/password", "secret/app/db/password"},
+		{"/secret/app/", "secret/", "app", "secret/app"},
+		{"team-a/app/db", "kv/team-a/", "app/db", "team-a/app/db"},
+		{"kv/team-a/app/db", "kv/team-a/", "app/db", "team-a/app/db"},
+		{"legacy/app", "team-a/", "app", "legacy/app"},
+	}
+
+	for _, table := range tables {
+		m, mpath, err := s.resolve(table.spath)
+		if err != nil {
+			t.Errorf("resolving '%v' returned an error: %v\n", table.spath, err)
+			continue
+		}
+		if m.Path != table.mount {
+			t.Errorf("mount of '%v' was incorrect, got: '%v', want: '%v'\n", table.spath, m.Path, table.mount)
+		}
+		if mpath != table.mpath {
+			t.Errorf("mount path of '%v' was incorrect, got: '%v', want: '%v'\n", table.spath, mpath, table.mpath)
+		}
+		if cpath := s.canonicalPath(table.spath); cpath != table.canonical {
+			t.Errorf("canonical path of '%v' was incorrect, got: '%v', want: '%v'\n", table.spath, cpath, table.canonical)
+		}
+	}
+
+	for _, spath := range []string{"", "secretsfiles/app", "kv/team-b/app"} {
+		if _, _, err := s.resolve(spath); err == nil {
+			t.Errorf("resolving '%v' returned no error\n", spath)
+		}
+	}
+}
+
+func TestMetadataSecret(t *testing.T) {
+	tables := []struct {
+		mode  int64
+		mpath string
+		want  string
+	}{
+		{sfsfh.DIRREAD, "app/db", "app/db"},
+		{sfsfh.FILEREAD, "app/db/password", "app/db"},
+		{sfsfh.DIRREAD, "", ""},
+		{sfsfh.FILEREAD, "password", ""},
+	}
+
+	for _, table := range tables {
+		got := metadataSecret(&Secret{Mode: table.mode}, table.mpath)
+		if got != table.want {
+			t.Errorf("metadata secret of '%v' was incorrect, got: '%v', want: '%v'\n", table.mpath, got, table.want)
+		}
+	}
+}
+
+func TestListedSecrets(t *testing.T) {
+	entries := []string{"db", "tls/", "app", "app/"}
+	want := []*Secret{
+		{Path: "secret/team/db", Mode: sfsfh.DIRREAD, HasKeys: true},
+		{Path: "secret/team/tls", Mode: sfsfh.DIRREAD},
+		{Path: "secret/team/app", Mode: sfsfh.DIRREAD, HasKeys: true},
+	}
+
+	got := listedSecrets("secret/team", entries)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed secrets of %v were incorrect, got: %+v, want: %+v.", entries, got, want)
+	}
+}
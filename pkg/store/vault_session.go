@@ -0,0 +1,331 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	sfsfh "github.com/muryoutaisuu/secretsfs/pkg/fusehelpers"
+)
+
+// vaultSession contains the logged in vault client of a user, so that the
+// user doesn't need to log in for every filesystem operation.
+type vaultSession struct {
+	mu        sync.Mutex
+	client    *api.Client
+	stamp     string        // identifies the credentials used for the login
+	ttl       time.Duration // ttl of the token as returned by the login
+	expires   time.Time     // expiry of the token, zero if it never expires
+	renewable bool
+	checked   time.Time // last lookup of the token after a denied request
+}
+
+// tokenCheckInterval limits how often the token of a session is looked up
+// after vault denied a request without reporting an invalid token, as denied
+// requests aren't cached and listing partly readable trees is denied often
+const tokenCheckInterval = 30 * time.Second
+
+// sessions contains all vaultSessions mapped to the uids of their users
+var sessions = make(map[string]*vaultSession)
+var sessionsMu sync.Mutex
+
+// getSession returns the vaultSession of the user with uid, an empty
+// vaultSession is created if none exists yet
+func getSession(uid string) *vaultSession {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[uid]
+	if !ok {
+		s = &vaultSession{}
+		sessions[uid] = s
+	}
+	return s
+}
+
+// sessionUser returns the user whose identity is used for accessing vault.
+// This is the calling user, or the user running secretsfs if
+// store.vault.auth.serviceidentity is enabled.
+func sessionUser(ctx context.Context) (*user.User, error) {
+	if viper.GetBool("store.vault.auth.serviceidentity") {
+		return user.Current()
+	}
+	// Get user doing the filesystem request
+	return sfsfh.GetUserFromContext(ctx)
+}
+
+// GetClient returns a vault client logged in as the calling user.
+// The context is used to detect the calling user and the AuthMethod configured
+// for him, see sessionUser. Tokens are cached per user and renewed before they
+// expire, a new login is only performed if the token can not be renewed any
+// more or the credentials of the user changed.
+func GetClient(ctx context.Context) (*api.Client, error) {
+	u, err := sessionUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := getSession(u.Uid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, err := getAuthMethod(u)
+	if err != nil {
+		s.reset()
+		return nil, NewError(ErrNoCredentials, err)
+	}
+	stamp, err := a.Stamp(u)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username":   u.Username,
+			"authmethod": a.String(),
+			"error":      err}).Error("could not access credentials of user")
+		s.reset()
+		return nil, NewError(ErrNoCredentials, err)
+	}
+	// changing the auth method of a user also changes the stamp
+	stamp = a.String() + "|" + stamp
+	if s.client != nil && s.stamp != stamp {
+		log.WithFields(log.Fields{"username": u.Username}).Info("credentials of user changed, logging in again")
+		s.reset()
+	}
+	if s.client != nil && s.expiring() && s.renewable {
+		if err := s.renew(); err != nil {
+			log.WithFields(log.Fields{
+				"username": u.Username,
+				"error":    err}).Warn("could not renew token, logging in again")
+			s.reset()
+		}
+	}
+	if s.client == nil || s.expiring() {
+		if err := s.login(a, u, stamp); err != nil {
+			return nil, err
+		}
+	}
+	return s.client, nil
+}
+
+// expiring returns true if less than a third of the token's ttl is left
+func (s *vaultSession) expiring() bool {
+	if s.expires.IsZero() {
+		return false
+	}
+	return time.Until(s.expires) < s.ttl/3
+}
+
+// reset drops the client of the session, so that the next call of GetClient
+// performs a new login
+func (s *vaultSession) reset() {
+	s.client = nil
+	s.stamp = ""
+	s.ttl = 0
+	s.expires = time.Time{}
+	s.renewable = false
+	s.checked = time.Time{}
+}
+
+// login logs in user u with AuthMethod a and stores the new client in the
+// session. stamp identifies the credentials used for the login.
+func (s *vaultSession) login(a AuthMethod, u *user.User, stamp string) error {
+	vc, err := newVaultClient()
+	if err != nil {
+		return err
+	}
+	auth, err := a.Login(vc, u)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username":   u.Username,
+			"authmethod": a.String(),
+			"error":      err}).Error("could not log in user")
+		return loginError(err)
+	}
+	vc.SetToken(auth.ClientToken)
+	s.reset()
+	s.client = vc
+	s.stamp = stamp
+	s.setLease(auth)
+	log.WithFields(log.Fields{
+		"username":   u.Username,
+		"authmethod": a.String(),
+		"ttl":        s.ttl,
+		"renewable":  s.renewable}).Debug("logged in user")
+	return nil
+}
+
+// renew renews the token of the session
+func (s *vaultSession) renew() error {
+	secret, err := s.client.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return errors.New("no auth info returned")
+	}
+	ttl := s.ttl
+	s.setLease(secret.Auth)
+	// keep the ttl of the login, so a token reaching its max ttl is recognized
+	// as expiring and replaced by a new login
+	s.ttl = ttl
+	return nil
+}
+
+// setLease sets the lifetime of the session's token
+func (s *vaultSession) setLease(auth *api.SecretAuth) {
+	s.renewable = auth.Renewable
+	s.ttl = time.Duration(auth.LeaseDuration) * time.Second
+	s.expires = time.Time{}
+	if s.ttl > 0 {
+		s.expires = time.Now().Add(s.ttl)
+	}
+}
+
+// dropInvalidSession checks whether the token of the calling user is still
+// valid after vault denied a request with the error denied. If it isn't, e.g.
+// because it was revoked, the session is dropped so that the next call of
+// GetClient logs in again. Unless vault reported an invalid token, the token
+// is only checked once per tokenCheckInterval. Returns true if the session was
+// dropped.
+func dropInvalidSession(ctx context.Context, denied error) bool {
+	u, err := sessionUser(ctx)
+	if err != nil {
+		return false
+	}
+	s := getSession(u.Uid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return false
+	}
+	if !invalidToken(denied) {
+		if time.Since(s.checked) < tokenCheckInterval {
+			return false
+		}
+		s.checked = time.Now()
+	}
+	if _, err := s.client.Auth().Token().LookupSelf(); responseStatus(err) != http.StatusForbidden {
+		return false
+	}
+	log.WithFields(log.Fields{"username": u.Username}).Info("token of user is not valid anymore, logging in again")
+	s.reset()
+	return true
+}
+
+// retryInvalidSession calls f and calls it once more with a new login, if vault
+// denied the request because the token of the calling user was revoked in the
+// meantime. The error returned by f is classified with vaultError.
+func retryInvalidSession(ctx context.Context, f func() error) error {
+	err := f()
+	if responseStatus(err) == http.StatusForbidden && dropInvalidSession(ctx, err) {
+		err = f()
+	}
+	return vaultError(err)
+}
+
+// invalidToken returns true if vault denied a request because of an invalid
+// token. Older versions of vault only report "permission denied".
+func invalidToken(err error) bool {
+	var re *api.ResponseError
+	if !errors.As(err, &re) {
+		return false
+	}
+	for _, e := range re.Errors {
+		if strings.Contains(e, "invalid token") {
+			return true
+		}
+	}
+	return false
+}
+
+// newVaultClient returns a vault client without token configured for
+// store.vault.addr
+func newVaultClient() (*api.Client, error) {
+	// Get default vault client configuration
+	conf := api.DefaultConfig()
+	a := viper.GetString("store.vault.addr")
+	conf.Address = a
+
+	// check TLS settings
+	if len(a) >= 5 && a[:5] == "https" {
+		if err := configureTLS(conf); err != nil {
+			log.WithFields(log.Fields{
+				"address": a,
+				"err":     err}).Fatal("got error while configuring TLS, shutting down")
+		}
+	}
+
+	// Create new vault client with vault configuration
+	vc, err := api.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	// api.NewClient reads VAULT_TOKEN of secretsfs' environment, which must
+	// never be used on behalf of a user
+	vc.ClearToken()
+	return vc, nil
+}
+
+// responseStatus returns the HTTP status code of an error returned by vault,
+// 0 if err is no response of vault
+func responseStatus(err error) int {
+	var re *api.ResponseError
+	if errors.As(err, &re) {
+		return re.StatusCode
+	}
+	return 0
+}
+
+// vaultError classifies err returned by vault as one of the typed errors.
+// Errors that are already classified and unknown errors are returned
+// unchanged.
+func vaultError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *storeError
+	if errors.As(err, &se) {
+		return err
+	}
+	switch status := responseStatus(err); {
+	case status == http.StatusNotFound:
+		return NewError(ErrNotFound, err)
+	case status == http.StatusForbidden:
+		return NewError(ErrPermissionDenied, err)
+	case status == http.StatusTooManyRequests || status >= 500:
+		// 503 is returned while vault is sealed or in standby
+		return NewError(ErrUnavailable, err)
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return NewError(ErrTimeout, err)
+	}
+	var ue *url.Error
+	var oe *net.OpError
+	if errors.As(err, &ue) || errors.As(err, &oe) {
+		return NewError(ErrUnavailable, err)
+	}
+	return err
+}
+
+// loginError classifies err returned by AuthMethod.Login as one of the typed
+// errors
+func loginError(err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return NewError(ErrNoCredentials, err)
+	}
+	switch responseStatus(err) {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		// vault rejected the credentials
+		return NewError(ErrAuthFailed, err)
+	}
+	return vaultError(err)
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// authServer is a fake vault logging in approles and serving the secret
+// secret/app to valid tokens
+type authServer struct {
+	mu        sync.Mutex
+	ttl       int // of logged in and renewed tokens in seconds
+	renewable bool
+	tokens    map[string]bool // valid tokens
+	roleIds   []string        // of all logins
+	renewals  int
+	lookups   int
+	denied    string // error returned for valid tokens reading secret/app, if set
+	invalid   string // error returned for invalid tokens
+}
+
+func (s *authServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	deny := func(msg string) {
+		reply(http.StatusForbidden, map[string]interface{}{"errors": []string{msg}})
+	}
+	auth := func(token string) map[string]interface{} {
+		return map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": s.ttl,
+			"renewable":      s.renewable,
+		}}
+	}
+	token := r.Header.Get("X-Vault-Token")
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		var body struct {
+			RoleId string `json:"role_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.roleIds = append(s.roleIds, body.RoleId)
+		token = "token" + strconv.Itoa(len(s.roleIds))
+		s.tokens[token] = true
+		reply(http.StatusOK, auth(token))
+	case "/v1/auth/token/renew-self":
+		if !s.tokens[token] {
+			deny(s.invalid)
+			return
+		}
+		s.renewals++
+		reply(http.StatusOK, auth(token))
+	case "/v1/auth/token/lookup-self":
+		s.lookups++
+		if !s.tokens[token] {
+			deny(s.invalid)
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"id": token}})
+	case "/v1/secret/app":
+		if !s.tokens[token] {
+			deny(s.invalid)
+		} else if s.denied != "" {
+			deny(s.denied)
+		} else {
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"token": token}})
+		}
+	default:
+		reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+// set changes the configuration of s with f
+func (s *authServer) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// revoke invalidates all tokens
+func (s *authServer) revoke() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]bool)
+}
+
+// counts returns the number of logins, renewals and lookups
+func (s *authServer) counts() (int, int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.roleIds), s.renewals, s.lookups
+}
+
+// startAuthServer starts s and configures secretsfs to log in with the role id
+// in the returned file. The returned function stops s and restores the
+// configuration.
+func startAuthServer(t *testing.T, s *authServer) (string, func()) {
+	dir, err := ioutil.TempDir("", "secretsfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleId := filepath.Join(dir, "roleid")
+	if err := ioutil.WriteFile(roleId, []byte("role1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	oldSessions := sessions
+	sessions = make(map[string]*vaultSession)
+	settings := map[string]interface{}{
+		"store.vault.addr":                 srv.URL,
+		"store.vault.auth.method":          "approle",
+		"store.vault.auth.serviceidentity": true,
+		"store.vault.roleid.file":          roleId,
+		"store.vault.secretid.file":        "",
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	return roleId, func() {
+		for k := range settings {
+			viper.Set(k, nil)
+		}
+		sessions = oldSessions
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// currentSession returns the session of the user running the tests
+func currentSession(t *testing.T) *vaultSession {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getSession(u.Uid)
+}
+
+func TestGetClient(t *testing.T) {
+	s := &authServer{ttl: 3600, renewable: true, tokens: make(map[string]bool)}
+	roleId, stop := startAuthServer(t, s)
+	defer stop()
+
+	// pretends that three quarters of the token's ttl passed, so that it is
+	// expiring
+	expire := func() {
+		session := currentSession(t)
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		session.expires = time.Now().Add(session.ttl / 4)
+	}
+
+	tables := []struct {
+		name     string
+		change   func()
+		token    string
+		logins   int
+		renewals int
+	}{
+		{"login", func() {}, "token1", 1, 0},
+		{"cached", func() {}, "token1", 1, 0},
+		{"renewed before expiry", expire, "token1", 1, 1},
+		{"renewed token cached", func() {}, "token1", 1, 1},
+		{"role id changed", func() { ioutil.WriteFile(roleId, []byte("role2.\n"), 0600) }, "token2", 2, 1},
+		{"renewal failed", func() { s.revoke(); expire() }, "token3", 3, 1},
+		{"not renewable", func() { s.set(func() { s.renewable = false }) }, "token3", 3, 1},
+		{"login not renewable", func() { s.revoke(); expire() }, "token4", 4, 1},
+		{"expiring not renewable", expire, "token5", 5, 1},
+	}
+
+	for _, table := range tables {
+		table.change()
+		c, err := GetClient(context.Background())
+		if err != nil {
+			t.Fatalf("getting client %s failed: %v", table.name, err)
+		}
+		logins, renewals, _ := s.counts()
+		if c.Token() != table.token || logins != table.logins || renewals != table.renewals {
+			t.Errorf("getting client %s was incorrect, got: %s, %d logins, %d renewals, want: %s, %d logins, %d renewals.", table.name, c.Token(), logins, renewals, table.token, table.logins, table.renewals)
+		}
+	}
+	if s.roleIds[0] != "role1" || s.roleIds[1] != "role2." {
+		t.Errorf("role ids of logins were incorrect, got: %v, want: [role1 role2. ...].", s.roleIds)
+	}
+}
+
+func TestRetryInvalidSession(t *testing.T) {
+	s := &authServer{ttl: 3600, renewable: true, tokens: make(map[string]bool)}
+	_, stop := startAuthServer(t, s)
+	defer stop()
+
+	read := func() error {
+		c, err := GetClient(context.Background())
+		if err != nil {
+			return err
+		}
+		_, err = c.Logical().Read("secret/app")
+		return err
+	}
+	// pretends that the token was last checked before tokenCheckInterval
+	outdate := func() {
+		session := currentSession(t)
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		session.checked = time.Now().Add(-tokenCheckInterval)
+	}
+
+	tables := []struct {
+		name    string
+		change  func()
+		err     error
+		logins  int
+		lookups int
+	}{
+		{"read", func() {}, nil, 1, 0},
+		{"revoked", func() { s.set(func() { s.invalid = "permission denied" }); s.revoke() }, nil, 2, 1},
+		{"denied", func() { s.set(func() { s.denied = "permission denied" }) }, ErrPermissionDenied, 2, 2},
+		{"denied again", func() {}, ErrPermissionDenied, 2, 2},
+		{"revoked while checked recently", s.revoke, ErrPermissionDenied, 2, 2},
+		{"revoked and checked long ago", func() { s.set(func() { s.denied = "" }); outdate() }, nil, 3, 3},
+		{"revoked with invalid token", func() {
+			s.set(func() { s.invalid = "2 errors occurred:\n\t* permission denied\n\t* invalid token\n\n" })
+			s.revoke()
+		}, nil, 4, 4},
+		{"revoked with invalid token again", s.revoke, nil, 5, 5},
+		{"denied after login", func() { s.set(func() { s.denied = "permission denied" }) }, ErrPermissionDenied, 5, 6},
+		{"denied again after login", func() {}, ErrPermissionDenied, 5, 6},
+	}
+
+	for _, table := range tables {
+		table.change()
+		err := retryInvalidSession(context.Background(), read)
+		logins, _, lookups := s.counts()
+		if !errors.Is(err, table.err) || (err != nil) != (table.err != nil) || logins != table.logins || lookups != table.lookups {
+			t.Errorf("reading %s was incorrect, got: %v, %d logins, %d lookups, want: %v, %d logins, %d lookups.", table.name, err, logins, lookups, table.err, table.logins, table.lookups)
+		}
+	}
+}
+
+func TestCertPaths(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("current user unknown:", err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip("primary group unknown:", err)
+	}
+	defaults := map[string]interface{}{"certfile": "$HOME/.vault/cert.pem", "keyfile": "$HOME/.vault/key.pem"}
+	group := map[string]interface{}{g.Name: map[string]interface{}{"certfile": "/etc/host.pem", "keyfile": "/etc/host.key"}}
+	users := map[string]interface{}{u.Username: map[string]interface{}{"certfile": "$HOME/user.pem", "keyfile": "$HOME/user.key"}}
+	homeGroup := map[string]interface{}{g.Name: map[string]interface{}{"certfile": "$HOME/host.pem", "keyfile": "$HOME/host.key"}}
+	otherGroup := map[string]interface{}{"secretsfs-no-such-group": map[string]interface{}{"certfile": "/etc/other.pem", "keyfile": "/etc/other.key"}}
+	none := map[string]interface{}{}
+
+	tables := []struct {
+		name     string
+		defaults map[string]interface{}
+		group    map[string]interface{}
+		user     map[string]interface{}
+		want     certFiles
+		err      error
+	}{
+		{"default", defaults, none, none, certFiles{CertFile: u.HomeDir + "/.vault/cert.pem", KeyFile: u.HomeDir + "/.vault/key.pem"}, nil},
+		{"group override", defaults, group, none, certFiles{CertFile: "/etc/host.pem", KeyFile: "/etc/host.key"}, nil},
+		{"other group", defaults, otherGroup, none, certFiles{CertFile: u.HomeDir + "/.vault/cert.pem", KeyFile: u.HomeDir + "/.vault/key.pem"}, nil},
+		{"user override", defaults, group, users, certFiles{CertFile: u.HomeDir + "/user.pem", KeyFile: u.HomeDir + "/user.key"}, nil},
+		{"group override in home", defaults, homeGroup, none, certFiles{CertFile: u.HomeDir + "/host.pem", KeyFile: u.HomeDir + "/host.key"}, nil},
+		{"group override without default", none, group, none, certFiles{CertFile: "/etc/host.pem", KeyFile: "/etc/host.key"}, nil},
+		{"nothing configured", none, none, none, certFiles{}, ErrNoCredentials},
+	}
+
+	defer func() {
+		for _, k := range []string{"certfile", "keyfile", "groupoverride", "useroverride"} {
+			viper.Set("store.vault.cert."+k, nil)
+		}
+	}()
+	for _, table := range tables {
+		viper.Set("store.vault.cert.certfile", table.defaults["certfile"])
+		viper.Set("store.vault.cert.keyfile", table.defaults["keyfile"])
+		viper.Set("store.vault.cert.groupoverride", table.group)
+		viper.Set("store.vault.cert.useroverride", table.user)
+		cf, err := certPaths(u)
+		if table.err != nil {
+			if !errors.Is(err, table.err) {
+				t.Errorf("certificate %s was incorrect, got: %v, want: %v.", table.name, err, table.err)
+			}
+			continue
+		}
+		if err != nil || cf != table.want {
+			t.Errorf("certificate %s was incorrect, got: %+v, %v, want: %+v.", table.name, cf, err, table.want)
+		}
+	}
+}